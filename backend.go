@@ -0,0 +1,98 @@
+package ohm
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Backend selects how a grammar is matched.
+type Backend int
+
+const (
+	// BackendInterpreter evaluates the grammar's expression tree directly.
+	BackendInterpreter Backend = iota
+
+	// BackendMachine compiles the grammar into a Program for the parsing
+	// machine.
+	BackendMachine
+
+	// BackendClosures compiles each expression into a Go closure.
+	BackendClosures
+)
+
+var backendNames = [...]string{
+	BackendInterpreter: "interpreter",
+	BackendMachine:     "machine",
+	BackendClosures:    "closures",
+}
+
+func (b Backend) String() string {
+	if b < 0 || int(b) >= len(backendNames) {
+		return fmt.Sprintf("Backend(%d)", int(b))
+	}
+	return backendNames[b]
+}
+
+// WithBackend returns a grammar with the same rules as g that's matched using
+// b. Compiled backends compile the grammar the first time it's matched.
+func (g *Grammar) WithBackend(b Backend) *Grammar {
+	ng := g.derive(g.rules)
+	ng.backend = nil
+	if b != BackendInterpreter {
+		ng.backend = &backend{kind: b, g: ng}
+	}
+	return ng
+}
+
+// derive returns a grammar with the given rules and the same settings as g.
+func (g *Grammar) derive(rules map[string]PExpr) *Grammar {
+	ng := &Grammar{super: g.super, rules: rules, memo: g.memo, bytes: g.bytes}
+	if g.memo != nil {
+		ng.memoRules = &memoResolver{g: ng}
+	}
+	if g.backend != nil {
+		ng.backend = &backend{kind: g.backend.kind, g: ng}
+	}
+	return ng
+}
+
+// Backend returns the backend used to match g.
+func (g *Grammar) Backend() Backend {
+	if g.backend == nil {
+		return BackendInterpreter
+	}
+	return g.backend.kind
+}
+
+type backend struct {
+	kind Backend
+	g    *Grammar
+
+	once     sync.Once
+	err      error
+	prog     *Program
+	closures *closureProgram
+}
+
+func (b *backend) compile() {
+	switch b.kind {
+	case BackendMachine:
+		b.prog, b.err = b.g.Compile()
+	case BackendClosures:
+		b.closures, b.err = b.g.compileClosures()
+	default:
+		b.err = fmt.Errorf("unknown backend %s", b.kind)
+	}
+}
+
+func (b *backend) match(name string, in *inputBuffer, opts MatchOptions) (*MatchResult, error) {
+	b.once.Do(b.compile)
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if b.prog != nil {
+		return b.prog.match(name, in, opts)
+	}
+	return b.closures.match(name, in, opts)
+}
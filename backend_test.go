@@ -0,0 +1,33 @@
+package ohm
+
+import "testing"
+
+func TestWithBackend(t *testing.T) {
+	g := OhmGrammar.WithBackend(BackendClosures)
+
+	if g.Backend() != BackendClosures {
+		t.Errorf("expected=%s actual=%s", BackendClosures, g.Backend())
+	}
+	if OhmGrammar.Backend() != BackendInterpreter {
+		t.Errorf("expected OhmGrammar to be unchanged, got %s", OhmGrammar.Backend())
+	}
+	if back := g.WithBackend(BackendInterpreter); back.Backend() != BackendInterpreter {
+		t.Errorf("expected=%s actual=%s", BackendInterpreter, back.Backend())
+	}
+}
+
+func TestBackendCompileError(t *testing.T) {
+	// Applies itself with a longer argument every time, so it has infinitely
+	// many instantiations.
+	g := grammar(map[string]PExpr{
+		"grow": alt(lit("a"), apply("grow", seq(param(0), param(0)))),
+	})
+	g.rules["start"] = apply("grow", lit("a"))
+
+	for _, b := range []Backend{BackendMachine, BackendClosures} {
+		_, err := g.WithBackend(b).MatchesRule("start", "a")
+		if err == nil {
+			t.Errorf("%s: expected an error", b)
+		}
+	}
+}
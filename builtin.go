@@ -1,35 +1,113 @@
 package ohm
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
+// Grammar is a set of rules that inputs can be matched against. Matching
+// never modifies a Grammar, so it can be matched from multiple goroutines at
+// once.
 type Grammar struct {
-	super *Grammar
-	rules map[string]PExpr
+	super   *Grammar
+	rules   map[string]PExpr
+	backend *backend
+	memo    *MemoConfig
+
+	// memoRules decides which rules are memoized according to memo, or is
+	// nil if memo is. It's shared by matches that don't override memo, so
+	// each rule's cost is only estimated once.
+	memoRules *memoResolver
+
+	// bytes holds the names of byte rules. See WithByteMode.
+	bytes map[string]bool
 }
 
 func (g *Grammar) MatchesRule(name, input string) (bool, error) {
+	res, err := g.Match(name, input)
+	if err != nil {
+		return false, err
+	}
+	return res.Succeeded(), nil
+}
+
+func (g *Grammar) Match(name, input string) (*MatchResult, error) {
+	return g.MatchWithOptions(name, input, MatchOptions{})
+}
+
+func (g *Grammar) MatchWithOptions(name, input string, opts MatchOptions) (*MatchResult, error) {
+	return g.match(name, newStringInput(input), opts)
+}
+
+// MatchReader matches the input read from r against the rule called name,
+// followed by the end of the input. Input is read as matching advances, and
+// only the part that could still be needed is kept in memory, so matching is
+// most efficient when the grammar uses cuts or has a top-level repetition.
+// Positions in errors are offsets from the start of the input.
+//
+// ctx is checked before each read, and during matching as with
+// MatchOptions.Context.
+func (g *Grammar) MatchReader(ctx context.Context, r io.Reader, name string) (*MatchResult, error) {
+	return g.MatchReaderWithOptions(ctx, r, name, MatchOptions{})
+}
+
+// MatchReaderWithOptions is like MatchReader, configured by opts. ctx takes
+// the place of opts.Context.
+func (g *Grammar) MatchReaderWithOptions(ctx context.Context, r io.Reader, name string, opts MatchOptions) (*MatchResult, error) {
+	opts.Context = ctx
+	return g.match(name, newReaderInput(ctx, r), opts)
+}
+
+// MatchPrefix matches the start of input against the rule called name. The
+// result's End is the length of the matched prefix.
+func (g *Grammar) MatchPrefix(name, input string) (*MatchResult, error) {
+	return g.MatchWithOptions(name, input, MatchOptions{Prefix: true})
+}
+
+func (g *Grammar) match(name string, in *inputBuffer, opts MatchOptions) (*MatchResult, error) {
+	return withLongestPrefix(in, opts, func(in *inputBuffer, opts MatchOptions) (*MatchResult, error) {
+		return g.matchOnce(name, in, opts)
+	})
+}
+
+func (g *Grammar) matchOnce(name string, in *inputBuffer, opts MatchOptions) (*MatchResult, error) {
+	if g.backend != nil {
+		return g.backend.match(name, in, opts)
+	}
+
 	// TODO: allow matching rules with args
 	a := Apply{name: name}
 	islex, err := a.isLexical()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	body := &Seq{[]PExpr{&Apply{name: name}, &Apply{name: "end"}}}
+	body := startBody(name, opts.Prefix)
 	root := call{app: &Apply{}, lexical: islex}
 
-	state := &MatchState{
-		g:     g,
-		input: input,
-		pos:   0,
-		stack: []call{root},
+	state := newMatchState(g, in, &opts)
+	defer state.free()
+	state.stack = append(state.stack, root)
+
+	res, err := state.eval(body)
+	if err != nil {
+		return nil, err
 	}
+	return state.result(res), nil
+}
 
-	return state.eval(body)
+// startBody returns what's matched to match the rule called name: the rule
+// followed by the end of the input, or just the rule when matching a prefix.
+func startBody(name string, prefix bool) PExpr {
+	if prefix {
+		return &Seq{[]PExpr{&Apply{name: name}}}
+	}
+	return &Seq{[]PExpr{&Apply{name: name}, &Apply{name: "end"}}}
 }
 
 type call struct {
@@ -38,31 +116,70 @@ type call struct {
 	lexical bool
 }
 
-type memoKey struct {
-	rule string
-	pos  int
-}
-
-type memoVal struct {
-	res bool
-	end int
-}
-
 type MatchState struct {
 	g     *Grammar
-	input string
+	in    *inputBuffer
 	pos   int
 	stack []call
-	memo  map[memoKey]memoVal
+	memo  *memoTable
+
+	// indent is the indentation stack, interned in memo. It's restored
+	// along with pos when backtracking. See IndentationSensitive.
+	indent int32
+
+	// captures holds the captures made so far, of which those from
+	// captureBase on belong to the current rule application. They're
+	// truncated when backtracking. See Capture.
+	captures    []capture
+	captureBase int
+
+	// diagnostics holds the errors recovered from so far. They're truncated
+	// when backtracking. See Recover.
+	diagnostics []Diagnostic
+
+	// appIDs holds memo IDs for applications with arguments.
+	appIDs map[string]int32
+
+	// memoRules decides which rules are memoized, or is nil if they all
+	// are. Decisions are cached in memoDecisions, which is indexed by rule
+	// ID, or by instantiation in compiled grammars.
+	memoRules     *memoResolver
+	memoDecisions []memoDecision
+	profile       MemoProfile
+
+	// limits enforces the match's resource limits, or is nil if there
+	// aren't any.
+	limits *limits
+
+	skips skipCache
+
+	// cut is the position of the last cut. Choice points that started
+	// before it fail instead of trying something else. choices counts the
+	// active choice points, and preds counts the active lookaheads, which
+	// scope the cuts inside them.
+	cut     int
+	choices int
+	preds   int
+
+	// fallback evaluates expressions that a compiled grammar doesn't know
+	// about with the interpreter. It has its own memo table, because
+	// compiled grammars use different memo IDs.
+	fallback *MatchState
+
+	// spare is the memo table the state had when it was pooled.
+	spare *memoTable
 }
 
+// spaces is applied to skip spaces in a syntactic context. Like the rest of
+// a grammar, it's never modified during matching, except for caching its
+// rule ID, which is done atomically.
 var spaces Apply = Apply{name: "spaces"}
 
 func (m *MatchState) eval(expr PExpr) (bool, error) {
-	pos := m.pos
+	pos, indent, captures, diagnostics := m.pos, m.indent, len(m.captures), len(m.diagnostics)
 
 	if !m.stack[len(m.stack)-1].lexical && expr != &spaces {
-		_, err := m.eval(&spaces)
+		err := m.skipSpaces()
 		if err != nil {
 			return false, err
 		}
@@ -74,32 +191,116 @@ func (m *MatchState) eval(expr PExpr) (bool, error) {
 	}
 
 	if !res {
-		m.pos = pos
+		m.pos, m.indent, m.captures = pos, indent, m.captures[:captures]
+		m.diagnostics = m.diagnostics[:diagnostics]
 		return false, nil
 	}
 	return true, nil
 }
 
-func (m *MatchState) memoized(rule string, pos int) (res bool, end int, ok bool) {
-	if m.memo == nil {
-		return false, 0, false
+// skipSpaces applies spaces at the current position, ignoring failure. In a
+// syntactic context this happens before every expression, so nested
+// expressions ask to skip from the same position over and over. Where
+// skipping ends only depends on where it starts, so recent results are
+// cached. The compiled backends insert skips into syntactic rule bodies
+// instead, but the interpreter evaluates a grammar's expressions as they
+// are, and the same expression can be passed as an argument to both
+// lexical and syntactic rules.
+func (m *MatchState) skipSpaces() error {
+	if end, ok := m.skips.lookup(m.pos); ok {
+		m.pos = end
+		return nil
+	}
+
+	start := m.pos
+	_, err := m.try(&spaces)
+	if err != nil {
+		return err
+	}
+	m.skips.store(start, m.pos)
+	return nil
+}
+
+// try evaluates expr at a choice point, where failure is followed by trying
+// something else from the same position.
+func (m *MatchState) try(expr PExpr) (bool, error) {
+	m.choices++
+	res, err := m.eval(expr)
+	m.choices--
+	return res, err
+}
+
+// predicate evaluates expr for a lookahead, restoring the position,
+// indentation, captures and diagnostics and undoing any cuts afterwards.
+func (m *MatchState) predicate(expr PExpr) (bool, error) {
+	pos, indent, captures, cut := m.pos, m.indent, len(m.captures), m.cut
+	diagnostics := len(m.diagnostics)
+	m.choices++
+	m.preds++
+
+	res, err := m.eval(expr)
+
+	m.choices--
+	m.preds--
+	m.pos, m.indent, m.captures, m.cut = pos, indent, m.captures[:captures], cut
+	m.diagnostics = m.diagnostics[:diagnostics]
+	return res, err
+}
+
+// cutAt records that nothing will backtrack to before pos.
+func (m *MatchState) cutAt(pos int) {
+	if pos > m.cut {
+		m.cut = pos
+	}
+	if m.preds == 0 {
+		m.release(pos)
 	}
+}
 
-	key := memoKey{rule, pos}
-	val, ok := m.memo[key]
-	if !ok {
-		return false, 0, false
+// settle is called after each iteration of a repetition. If there are no
+// choice points left, nothing can backtrack to before the current position,
+// so it behaves like a cut.
+func (m *MatchState) settle() {
+	if m.choices == 0 {
+		m.release(m.pos)
 	}
-	return val.res, val.end, true
 }
 
-func (m *MatchState) memoize(rule string, start int, res bool, end int) {
-	if m.memo == nil {
-		m.memo = make(map[memoKey]memoVal)
+// release drops memoized results and input before pos.
+func (m *MatchState) release(pos int) {
+	m.memo.release(pos)
+	m.in.release(pos)
+}
+
+// cutPast reports whether a cut happened after start, which means a choice
+// point at start mustn't try anything else.
+func (m *MatchState) cutPast(start int) bool {
+	return m.cut > start
+}
+
+// skipCache holds the start and end positions of the last two space skips.
+// Two entries are enough to cover skipping from a position and then skipping
+// again from where that ended. Positions are stored plus one so the zero
+// value is empty.
+type skipCache struct {
+	from [2]int
+	to   [2]int
+	next int
+}
+
+func (c *skipCache) lookup(pos int) (int, bool) {
+	for i, from := range c.from {
+		if from == pos+1 {
+			return c.to[i] - 1, true
+		}
 	}
+	return 0, false
+}
 
-	key := memoKey{rule, start}
-	m.memo[key] = memoVal{res, end}
+func (c *skipCache) store(from, to int) {
+	c.from[c.next] = from + 1
+	c.to[c.next] = to + 1
+	c.next ^= 1
 }
 
 type PExpr interface {
@@ -110,13 +311,9 @@ type PExpr interface {
 type Any struct{}
 
 func (*Any) Eval(m *MatchState) (bool, error) {
-	if m.pos >= len(m.input) {
-		return false, nil
-	}
-
-	r, size := utf8.DecodeRuneInString(m.input[m.pos:])
-	if r == utf8.RuneError {
-		return false, fmt.Errorf("invalid rune at pos %d", m.pos)
+	_, size, err := m.in.peek(m.pos)
+	if err != nil || size == 0 {
+		return false, err
 	}
 
 	m.pos += size
@@ -132,13 +329,9 @@ type Char struct {
 }
 
 func (c *Char) Eval(m *MatchState) (bool, error) {
-	if m.pos >= len(m.input) {
-		return false, nil
-	}
-
-	r, size := utf8.DecodeRuneInString(m.input[m.pos:])
-	if r == utf8.RuneError {
-		return false, fmt.Errorf("invalid rune at pos %d", m.pos)
+	r, size, err := m.in.peek(m.pos)
+	if err != nil || size == 0 {
+		return false, err
 	}
 
 	if r != c.r {
@@ -157,13 +350,9 @@ type Chars struct {
 }
 
 func (c *Chars) Eval(m *MatchState) (bool, error) {
-	if m.pos >= len(m.input) {
-		return false, nil
-	}
-
-	r, size := utf8.DecodeRuneInString(m.input[m.pos:])
-	if r == utf8.RuneError {
-		return false, fmt.Errorf("invalid rune at pos %d", m.pos)
+	r, size, err := m.in.peek(m.pos)
+	if err != nil || size == 0 {
+		return false, err
 	}
 
 	for _, rune := range c.runes {
@@ -186,13 +375,9 @@ type Range struct {
 }
 
 func (r *Range) Eval(m *MatchState) (bool, error) {
-	if m.pos >= len(m.input) {
-		return false, nil
-	}
-
-	actual, size := utf8.DecodeRuneInString(m.input[m.pos:])
-	if actual == utf8.RuneError {
-		return false, fmt.Errorf("invalid rune at pos %d", m.pos)
+	actual, size, err := m.in.peek(m.pos)
+	if err != nil || size == 0 {
+		return false, err
 	}
 
 	if actual < r.start || actual > r.end {
@@ -212,14 +397,24 @@ type Alt struct {
 }
 
 func (a *Alt) Eval(m *MatchState) (bool, error) {
-	for _, expr := range a.exprs {
-		res, err := m.eval(expr)
+	start := m.pos
+	for i, expr := range a.exprs {
+		var res bool
+		var err error
+		if i < len(a.exprs)-1 {
+			res, err = m.try(expr)
+		} else {
+			res, err = m.eval(expr)
+		}
 		if err != nil {
 			return false, err
 		}
 		if res {
 			return true, nil
 		}
+		if m.cutPast(start) {
+			return false, nil
+		}
 	}
 
 	return false, nil
@@ -272,11 +467,12 @@ type Maybe struct {
 }
 
 func (o *Maybe) Eval(m *MatchState) (bool, error) {
-	_, err := m.eval(o.expr)
+	start := m.pos
+	res, err := m.try(o.expr)
 	if err != nil {
 		return false, err
 	}
-	return true, nil
+	return res || !m.cutPast(start), nil
 }
 
 func (o *Maybe) substituteParams(args []PExpr) (PExpr, error) {
@@ -292,16 +488,33 @@ type Star struct {
 }
 
 func (s *Star) Eval(m *MatchState) (bool, error) {
+	return m.repeat(s.expr)
+}
+
+// repeat evaluates expr until it fails.
+func (m *MatchState) repeat(expr PExpr) (bool, error) {
 	for {
-		res, err := m.eval(s.expr)
+		start := m.pos
+		res, err := m.try(expr)
 		if err != nil {
 			return false, err
 		}
 		if !res {
-			break
+			return !m.cutPast(start), nil
+		}
+		m.settle()
+		if err := m.step(); err != nil {
+			return false, err
 		}
 	}
-	return true, nil
+}
+
+// step counts an iteration of a repetition against the match's limits.
+func (m *MatchState) step() error {
+	if m.limits == nil {
+		return nil
+	}
+	return m.limits.step(m.pos)
 }
 
 func (s *Star) substituteParams(args []PExpr) (PExpr, error) {
@@ -321,72 +534,167 @@ func (p *Plus) Eval(m *MatchState) (bool, error) {
 	if err != nil || !res {
 		return res, err
 	}
+	m.settle()
+	return m.repeat(p.expr)
+}
 
-	for {
-		res, err := m.eval(p.expr)
+func (p *Plus) substituteParams(args []PExpr) (PExpr, error) {
+	newExpr, err := p.expr.substituteParams(args)
+	if err != nil {
+		return nil, err
+	}
+	return &Plus{newExpr}, nil
+}
+
+// Repeat matches expr at least min and at most max times, or any number of
+// times past min if max is negative. It's written e{n}, e{n,m} or e{n,} in
+// OhmGrammarWithRepetition. A maximum less than the minimum is an error.
+type Repeat struct {
+	expr     PExpr
+	min, max int
+}
+
+func (r *Repeat) Eval(m *MatchState) (bool, error) {
+	if err := r.checkBounds(); err != nil {
+		return false, err
+	}
+
+	for i := 0; i < r.min; i++ {
+		res, err := m.eval(r.expr)
+		if err != nil || !res {
+			return res, err
+		}
+		m.settle()
+		if err := m.step(); err != nil {
+			return false, err
+		}
+	}
+	if r.max < 0 {
+		return m.repeat(r.expr)
+	}
+
+	for i := r.min; i < r.max; i++ {
+		start := m.pos
+		res, err := m.try(r.expr)
 		if err != nil {
 			return false, err
 		}
 		if !res {
-			break
+			return !m.cutPast(start), nil
+		}
+		m.settle()
+		if err := m.step(); err != nil {
+			return false, err
 		}
 	}
 	return true, nil
 }
 
-func (p *Plus) substituteParams(args []PExpr) (PExpr, error) {
-	newExpr, err := p.expr.substituteParams(args)
+// checkBounds returns an error if r's maximum is less than its minimum.
+func (r *Repeat) checkBounds() error {
+	if r.max >= 0 && r.max < r.min {
+		return fmt.Errorf("invalid repetition bounds: {%d,%d}", r.min, r.max)
+	}
+	return nil
+}
+
+func (r *Repeat) substituteParams(args []PExpr) (PExpr, error) {
+	newExpr, err := r.expr.substituteParams(args)
 	if err != nil {
 		return nil, err
 	}
-	return &Plus{newExpr}, nil
+	return &Repeat{expr: newExpr, min: r.min, max: r.max}, nil
 }
 
 type Apply struct {
 	name string
 	args []PExpr
+
+	// id caches the interned rule name. See ruleID.
+	id int32
 }
 
 func (a *Apply) Eval(m *MatchState) (bool, error) {
-	res, end, ok := m.memoized(a.name, m.pos)
-	if ok {
-		m.pos = end
-		return res, nil
+	app := a
+	if len(a.args) > 0 {
+		caller := m.stack[len(m.stack)-1]
+		newApp, err := a.substituteParams(caller.app.args)
+		if err != nil {
+			return false, err
+		}
+		app = newApp.(*Apply)
 	}
 
-	islex, err := a.isLexical()
-	if err != nil {
-		return false, err
+	if m.limits != nil {
+		if err := m.limits.step(m.pos); err != nil {
+			return false, err
+		}
 	}
 
-	caller := m.stack[len(m.stack)-1]
-	app, err := a.substituteParams(caller.app.args)
+	var id int32
+	if m.memoizes(a) {
+		id = m.memoID(app)
+	}
+	if id != 0 {
+		e, ok := m.memo.get(id, m.pos, m.indent)
+		if m.profile != nil {
+			m.profile.record(a.name, ok)
+		}
+		if ok {
+			m.replay(e)
+			return e.res, nil
+		}
+	}
+
+	islex, err := a.isLexical()
 	if err != nil {
 		return false, err
 	}
 
-	m.stack = append(m.stack, call{app: app.(*Apply), pos: m.pos, lexical: islex})
+	if m.limits != nil {
+		if err := m.limits.enter(m.pos); err != nil {
+			return false, err
+		}
+	}
+	m.stack = append(m.stack, call{app: app, pos: m.pos, lexical: islex})
+	captureBase := m.captureBase
+	m.captureBase = len(m.captures)
 
 	defer func() {
 		m.stack = m.stack[:len(m.stack)-1]
+		m.captures = m.captures[:m.captureBase]
+		m.captureBase = captureBase
+		if m.limits != nil {
+			m.limits.exit()
+		}
 	}()
 
-	start := m.pos
+	start, indent, diagnostics := m.pos, m.indent, len(m.diagnostics)
 
 	g := m.g
 	for g != nil {
 		expr := g.rules[a.name]
 		if expr != nil {
+			examined := m.in.enter(start)
 			res, err := m.eval(expr)
 			if err != nil {
 				return false, err
 			}
-			if res {
-				m.memoize(a.name, start, true, m.pos)
-				return true, nil
+
+			e := memoEntry{id: id, res: res, cut: m.cutPast(start), end: m.pos}
+			m.in.exit(examined, &e)
+			// The diagnostics of applications that recovered from errors
+			// are replayed along with their results.
+			if id != 0 && m.memo.indented(&e, indent, m.indent) {
+				m.memo.set(start, e)
+				m.memo.diagnose(start, id, m.diagnostics[diagnostics:])
+				if m.limits != nil {
+					if err := m.limits.memoized(m.memo, start); err != nil {
+						return false, err
+					}
+				}
 			}
-			m.memoize(a.name, start, false, start)
-			return false, nil
+			return res, nil
 		}
 
 		g = g.super
@@ -403,7 +711,7 @@ func (a *Apply) substituteParams(args []PExpr) (PExpr, error) {
 		}
 		newArgs[i] = newArg
 	}
-	return &Apply{a.name, newArgs}, nil
+	return &Apply{name: a.name, args: newArgs}, nil
 }
 
 func (a *Apply) isLexical() (bool, error) {
@@ -439,9 +747,7 @@ type Lookahead struct {
 }
 
 func (l *Lookahead) Eval(m *MatchState) (bool, error) {
-	pos := m.pos
-	defer func() { m.pos = pos }()
-	return m.eval(l.expr)
+	return m.predicate(l.expr)
 }
 
 func (l *Lookahead) substituteParams(args []PExpr) (PExpr, error) {
@@ -457,9 +763,7 @@ type Not struct {
 }
 
 func (n *Not) Eval(m *MatchState) (bool, error) {
-	pos := m.pos
-	defer func() { m.pos = pos }()
-	res, err := m.eval(n.expr)
+	res, err := m.predicate(n.expr)
 	if err != nil {
 		return false, err
 	}
@@ -474,6 +778,24 @@ func (n *Not) substituteParams(args []PExpr) (PExpr, error) {
 	return &Not{newExpr}, nil
 }
 
+// Cut always succeeds, and commits to everything matched so far: choice
+// points that started before it fail instead of trying another
+// alternative. Cuts inside a lookahead only last until the lookahead ends.
+//
+// Since nothing can backtrack past a cut, memoized results before it are
+// released, which keeps memory bounded when matching long inputs made of
+// independent records.
+type Cut struct{}
+
+func (*Cut) Eval(m *MatchState) (bool, error) {
+	m.cutAt(m.pos)
+	return true, nil
+}
+
+func (c *Cut) substituteParams(args []PExpr) (PExpr, error) {
+	return c, nil
+}
+
 type ucType int
 
 const (
@@ -489,13 +811,9 @@ type UnicodeCategories struct {
 }
 
 func (c *UnicodeCategories) Eval(m *MatchState) (bool, error) {
-	if m.pos >= len(m.input) {
-		return false, nil
-	}
-
-	r, size := utf8.DecodeRuneInString(m.input[m.pos:])
-	if r == utf8.RuneError {
-		return false, fmt.Errorf("invalid rune at pos %d", m.pos)
+	r, size, err := m.in.peek(m.pos)
+	if err != nil || size == 0 {
+		return false, err
 	}
 
 	// Special case lower and upper so we can use Go's IsLower and IsUpper functions
@@ -523,21 +841,22 @@ func (c *UnicodeCategories) substituteParams(args []PExpr) (PExpr, error) {
 	return c, nil
 }
 
-var lower UnicodeCategories = UnicodeCategories{kind: ucTypeLower}
-var upper UnicodeCategories = UnicodeCategories{kind: ucTypeUpper}
-var ltmo UnicodeCategories = UnicodeCategories{
-	kind:   ucTypeRanges,
-	ranges: []*unicode.RangeTable{unicode.Lt, unicode.Lm, unicode.Lo},
-	names:  []string{"Lt", "Lm", "Lo"},
-}
-
 var primitiveRules Grammar = Grammar{
 	super: nil,
 	rules: map[string]PExpr{
-		"any":         &Any{},
-		"lower":       &lower,
-		"upper":       &upper,
-		"unicodeLtmo": &ltmo,
+		"any":   &Any{},
+		"lower": &UnicodeCategories{kind: ucTypeLower},
+		"upper": &UnicodeCategories{kind: ucTypeUpper},
+		"unicodeLtmo": &UnicodeCategories{
+			kind:   ucTypeRanges,
+			ranges: []*unicode.RangeTable{unicode.Lt, unicode.Lm, unicode.Lo},
+			names:  []string{"Lt", "Lm", "Lo"},
+		},
+
+		"anyByte": &ByteRange{0, 0xff},
+
+		// Only bytes from 0x80 up can be invalid. See InvalidUTF8Bytes.
+		"invalidByte": &Range{invalidByteBase + 0x80, invalidByteBase + 0xff},
 	},
 }
 
@@ -551,13 +870,13 @@ var BuiltInRules Grammar = Grammar{
 		"digit":    &Range{'0', '9'},
 		"hexDigit": &Alt{[]PExpr{&Apply{name: "digit"}, &Range{'a', 'f'}, &Range{'A', 'F'}}},
 		"ListOf": &Alt{[]PExpr{
-			&Apply{"NonemptyListOf", []PExpr{&Param{0}, &Param{1}}},
-			&Apply{"EmptyListOf", []PExpr{&Param{0}, &Param{1}}},
+			&Apply{name: "NonemptyListOf", args: []PExpr{&Param{0}, &Param{1}}},
+			&Apply{name: "EmptyListOf", args: []PExpr{&Param{0}, &Param{1}}},
 		}},
 		"NonemptyListOf": &Seq{[]PExpr{&Param{0}, &Star{&Seq{[]PExpr{&Param{1}, &Param{0}}}}}},
 		"EmptyListOf":    &Seq{},
 		"listOf": &Alt{[]PExpr{
-			&Apply{"nonemptyListOf", []PExpr{&Param{0}, &Param{1}}},
+			&Apply{name: "nonemptyListOf", args: []PExpr{&Param{0}, &Param{1}}},
 			&Apply{name: "emptyListOf", args: []PExpr{&Param{0}, &Param{1}}},
 		}},
 		"nonemptyListOf": &Seq{[]PExpr{&Param{0}, &Star{&Seq{[]PExpr{&Param{1}, &Param{0}}}}}},
@@ -782,12 +1101,7 @@ var OhmGrammar Grammar = Grammar{
 		"escapeChar_tab":            &Seq{[]PExpr{&Char{'\\'}, &Char{'t'}}},
 		"escapeChar_unicodeCodePoint": &Seq{[]PExpr{
 			&Seq{[]PExpr{&Char{'\\'}, &Char{'u'}, &Char{'{'}}},
-			&Apply{name: "hexDigit"},
-			&Maybe{&Apply{name: "hexDigit"}},
-			&Maybe{&Apply{name: "hexDigit"}},
-			&Maybe{&Apply{name: "hexDigit"}},
-			&Maybe{&Apply{name: "hexDigit"}},
-			&Maybe{&Apply{name: "hexDigit"}},
+			&Repeat{expr: &Apply{name: "hexDigit"}, min: 1, max: 6},
 			&Char{'}'},
 		}},
 		"escapeChar_unicodeEscape": &Seq{[]PExpr{
@@ -846,3 +1160,52 @@ var OhmGrammar Grammar = Grammar{
 		}},
 	},
 }
+
+// OhmGrammarWithRepetition is OhmGrammar extended with bounded repetition:
+// e{n} matches e n times, e{n,m} between n and m times, and e{n,} at least n
+// times. Bounds where m is less than n aren't accepted. It's separate from
+// OhmGrammar because Ohm-js doesn't accept it.
+//
+// This package only recognizes grammars. It doesn't build CSTs or print
+// expressions, so there are no iteration nodes or printing for Repeat yet.
+var OhmGrammarWithRepetition Grammar = Grammar{
+	super: &OhmGrammar,
+	rules: map[string]PExpr{
+		"Iter": &Alt{[]PExpr{
+			&Apply{name: "Iter_star"},
+			&Apply{name: "Iter_plus"},
+			&Apply{name: "Iter_opt"},
+			&Apply{name: "Iter_repeat"},
+			&Apply{name: "Pred"},
+		}},
+		"Iter_repeat": &Seq{[]PExpr{
+			&Apply{name: "Pred"},
+			&Apply{name: "repeatBounds"},
+		}},
+		"repeatBounds": &SemanticPredicate{
+			name: "repeatBounds",
+			expr: &Seq{[]PExpr{
+				&Char{'{'},
+				&Plus{&Apply{name: "digit"}},
+				&Maybe{&Seq{[]PExpr{&Char{','}, &Star{&Apply{name: "digit"}}}}},
+				&Char{'}'},
+			}},
+			fn: orderedRepeatBounds,
+		},
+	},
+}
+
+// orderedRepeatBounds reports whether the bounds {n}, {n,m} or {n,} in text
+// are in range and have m no less than n.
+func orderedRepeatBounds(text string) bool {
+	min, max, hasMax := strings.Cut(strings.Trim(text, "{}"), ",")
+	n, err := strconv.Atoi(min)
+	if err != nil {
+		return false
+	}
+	if !hasMax || max == "" {
+		return true
+	}
+	m, err := strconv.Atoi(max)
+	return err == nil && m >= n
+}
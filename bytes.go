@@ -0,0 +1,174 @@
+package ohm
+
+import "fmt"
+
+// ByteRange matches a single byte between start and end, inclusive. Unlike
+// the other primitives, it doesn't decode runes, so it can match any part of
+// the input, including invalid UTF-8.
+type ByteRange struct {
+	start byte
+	end   byte
+}
+
+func (r *ByteRange) Eval(m *MatchState) (bool, error) {
+	b, ok, err := m.in.peekByte(m.pos)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if b < r.start || b > r.end {
+		return false, nil
+	}
+
+	m.pos++
+	return true, nil
+}
+
+func (r *ByteRange) substituteParams(args []PExpr) (PExpr, error) {
+	return r, nil
+}
+
+// WithByteMode returns a grammar like g in which the rules called names, or
+// all of g's own rules if there are none, match bytes instead of runes. In
+// their bodies, any matches a single byte, and characters and ranges match
+// the bytes with the same values, so "\x00".."\x7f" matches a byte below
+// 0x80. Characters past "\xff" and Unicode categories are an error. Rules
+// applied from byte rules are matched as usual, so byte rules and text
+// rules can be mixed. Byte rules should be lexical, since spaces are
+// skipped as text.
+func (g *Grammar) WithByteMode(names ...string) (*Grammar, error) {
+	if len(names) == 0 {
+		for name := range g.rules {
+			names = append(names, name)
+		}
+	}
+
+	rules := make(map[string]PExpr, len(g.rules))
+	for name, body := range g.rules {
+		rules[name] = body
+	}
+	bytes := make(map[string]bool, len(g.bytes)+len(names))
+	for name := range g.bytes {
+		bytes[name] = true
+	}
+
+	for _, name := range names {
+		var body PExpr
+		for sg := g; sg != nil && body == nil; sg = sg.super {
+			body = sg.rules[name]
+		}
+		if body == nil {
+			return nil, fmt.Errorf("unknown rule \"%s\"", name)
+		}
+
+		b, err := byteExpr(body, name)
+		if err != nil {
+			return nil, err
+		}
+		rules[name] = b
+		bytes[name] = true
+	}
+
+	ng := g.derive(rules)
+	ng.bytes = bytes
+	return ng, nil
+}
+
+// byteExpr returns a copy of expr, the body of the rule called rule, that
+// matches bytes instead of runes.
+func byteExpr(expr PExpr, rule string) (PExpr, error) {
+	all := func(exprs []PExpr) ([]PExpr, error) {
+		newExprs := make([]PExpr, len(exprs))
+		for i, expr := range exprs {
+			newExpr, err := byteExpr(expr, rule)
+			if err != nil {
+				return nil, err
+			}
+			newExprs[i] = newExpr
+		}
+		return newExprs, nil
+	}
+
+	switch e := expr.(type) {
+	case *Any:
+		return &ByteRange{0, 0xff}, nil
+	case *Char:
+		return byteRanges([]runeRange{{e.r, e.r}}, rule)
+	case *Chars:
+		var ranges []runeRange
+		for _, r := range e.runes {
+			ranges = append(ranges, runeRange{r, r})
+		}
+		return byteRanges(ranges, rule)
+	case *Range:
+		return byteRanges([]runeRange{{e.start, e.end}}, rule)
+	case *CharClass:
+		var ranges []runeRange
+		for r := rune(0); r < 0x80; r++ {
+			if e.contains(r) {
+				ranges = append(ranges, runeRange{r, r})
+			}
+		}
+		return byteRanges(append(ranges, e.ranges...), rule)
+	case *UnicodeCategories:
+		return nil, fmt.Errorf("unicode category in byte rule \"%s\"", rule)
+	case *Alt:
+		exprs, err := all(e.exprs)
+		return &Alt{exprs}, err
+	case *DispatchAlt:
+		// The dispatch table is for runes.
+		exprs, err := all(e.exprs)
+		return &Alt{exprs}, err
+	case *Seq:
+		exprs, err := all(e.exprs)
+		return &Seq{exprs}, err
+	case *Maybe:
+		expr, err := byteExpr(e.expr, rule)
+		return &Maybe{expr}, err
+	case *Star:
+		expr, err := byteExpr(e.expr, rule)
+		return &Star{expr}, err
+	case *Plus:
+		expr, err := byteExpr(e.expr, rule)
+		return &Plus{expr}, err
+	case *Repeat:
+		expr, err := byteExpr(e.expr, rule)
+		return &Repeat{expr: expr, min: e.min, max: e.max}, err
+	case *Lookahead:
+		expr, err := byteExpr(e.expr, rule)
+		return &Lookahead{expr}, err
+	case *Not:
+		expr, err := byteExpr(e.expr, rule)
+		return &Not{expr}, err
+	case *Capture:
+		expr, err := byteExpr(e.expr, rule)
+		return &Capture{name: e.name, expr: expr}, err
+	case *Recover:
+		expr, err := byteExpr(e.expr, rule)
+		return &Recover{name: e.name, expr: expr, sync: e.sync, bytes: true}, err
+	case *Apply:
+		if len(e.args) == 0 {
+			return e, nil
+		}
+		args, err := all(e.args)
+		return &Apply{name: e.name, args: args}, err
+	default:
+		return e, nil
+	}
+}
+
+// byteRanges returns an expression that matches a byte in any of ranges.
+func byteRanges(ranges []runeRange, rule string) (PExpr, error) {
+	var exprs []PExpr
+	for _, r := range normalizeRanges(ranges) {
+		if r.hi > 0xff {
+			return nil, fmt.Errorf("rune %U in byte rule \"%s\" is not a byte", max(r.lo, 0x100), rule)
+		}
+		exprs = append(exprs, &ByteRange{byte(r.lo), byte(r.hi)})
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return &Alt{exprs}, nil
+}
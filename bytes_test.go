@@ -0,0 +1,68 @@
+package ohm
+
+import "testing"
+
+func TestByteMode(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"file":   seq(apply("header"), apply("ascii"), apply("chunk"), &Star{apply("letter")}),
+		"header": seq(lit("\u0089PNG"), &Chars{[]rune{'\r', '\n'}}),
+		"ascii":  &Range{'\u0000', '\u007f'},
+		"chunk":  seq(apply("anyByte"), &Any{}, &Not{lit("ÿ")}, &Any{}),
+	})
+
+	bg, err := g.WithByteMode("header", "ascii", "chunk")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		input   string
+		matches bool
+	}{
+		{"\x89PNG\rx\xff\x00\x01é", true},
+		{"\x89PNG\n\x00\xc3\xa9\x00abc", true},
+		{"\x89PNG\n\x00\x01\x02\xffabc", false},
+		{"\x89PNG\n\x80\x00\x00\x00", false},
+		{"\u0089PNG\n\x00\x00\x00\x00", false},
+		{"\x89PNG\n\x00\x00\x00", false},
+	}
+
+	names, grammars := variants(bg)
+	for i, g := range grammars {
+		for _, test := range tests {
+			res, err := g.MatchesRule("file", test.input)
+			if err != nil {
+				t.Fatalf("%s: input=%q: unexpected error: %s", names[i], test.input, err)
+			}
+			if res != test.matches {
+				t.Errorf("%s: input=%q expected=%v actual=%v", names[i], test.input, test.matches, res)
+			}
+		}
+	}
+}
+
+func TestByteModeErrors(t *testing.T) {
+	tests := []struct {
+		body PExpr
+		err  string
+	}{
+		{lit("é"), ""},
+		{lit("ā"), `rune U+0101 in byte rule "start" is not a byte`},
+		{&Range{'a', 'ā'}, `rune U+0100 in byte rule "start" is not a byte`},
+		{&Star{&UnicodeCategories{kind: ucTypeLower}}, `unicode category in byte rule "start"`},
+	}
+
+	for _, test := range tests {
+		g := grammar(map[string]PExpr{"start": test.body})
+		_, err := g.WithByteMode()
+		if test.err == "" && err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("expected=%s actual=%v", test.err, err)
+		}
+	}
+
+	if _, err := OhmGrammar.WithByteMode("missing"); err == nil || err.Error() != `unknown rule "missing"` {
+		t.Errorf("expected an unknown rule error, got %v", err)
+	}
+}
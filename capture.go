@@ -0,0 +1,114 @@
+package ohm
+
+// Capture matches expr and records the input it matched under name, for
+// BackReferences later in the same rule application. Captures are local to
+// the application they're made in: rules it applies, including through
+// arguments, start with none, and they're gone when it returns. That makes
+// the result of an application independent of captures made outside it, so
+// it's memoized as usual. Captures are undone when backtracking, and at the
+// end of a lookahead.
+type Capture struct {
+	name string
+	expr PExpr
+}
+
+func (c *Capture) Eval(m *MatchState) (bool, error) {
+	// Like a semantic predicate, nothing is released while matching expr.
+	start := m.pos
+	m.choices++
+	m.preds++
+	res, err := m.eval(c.expr)
+	m.choices--
+	m.preds--
+	if err != nil || !res {
+		return false, err
+	}
+
+	captured, err := newCapture(m.in, c.name, start, m.pos)
+	if err != nil {
+		return false, err
+	}
+	m.captures = append(m.captures, captured)
+	return true, nil
+}
+
+func (c *Capture) substituteParams(args []PExpr) (PExpr, error) {
+	newExpr, err := c.expr.substituteParams(args)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{name: c.name, expr: newExpr}, nil
+}
+
+// BackReference matches exactly the input matched by the last Capture with
+// the same name in the current rule application, or tokens with the same
+// kinds and values. It fails if there isn't one.
+type BackReference struct {
+	name string
+}
+
+func (b *BackReference) Eval(m *MatchState) (bool, error) {
+	end, ok, err := backReference(m.in, m.captures[m.captureBase:], b.name, m.pos)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	m.pos = end
+	return true, nil
+}
+
+func (b *BackReference) substituteParams(args []PExpr) (PExpr, error) {
+	return b, nil
+}
+
+// backReference matches the last capture called name in captures at pos,
+// returning where it ended.
+func backReference(in *inputBuffer, captures []capture, name string, pos int) (int, bool, error) {
+	for i := len(captures) - 1; i >= 0; i-- {
+		if captures[i].name == name {
+			return captures[i].match(in, pos)
+		}
+	}
+	return pos, false, nil
+}
+
+// capture is the input between start and end that was captured under name.
+// The text is kept, since the input it came from can be released once the
+// capture is made.
+type capture struct {
+	name       string
+	start, end int
+	text       string
+}
+
+func newCapture(in *inputBuffer, name string, start, end int) (capture, error) {
+	c := capture{name: name, start: start, end: end}
+	if in.tokens != nil {
+		return c, nil
+	}
+
+	var err error
+	c.text, err = in.text(start, end)
+	return c, err
+}
+
+// match matches the captured input at pos, returning where it ended.
+func (c capture) match(in *inputBuffer, pos int) (int, bool, error) {
+	if in.tokens != nil {
+		for i := c.start; i < c.end; i++ {
+			tok, ok := in.token(pos + i - c.start)
+			if !ok || tok.Kind != in.tokens.Token(i).Kind || tok.Value != in.tokens.Token(i).Value {
+				return pos, false, nil
+			}
+		}
+		return pos + c.end - c.start, true, nil
+	}
+
+	for i := 0; i < len(c.text); i++ {
+		b, ok, err := in.peekByte(pos + i)
+		if err != nil || !ok || b != c.text[i] {
+			return pos, false, err
+		}
+	}
+	return pos + len(c.text), true, nil
+}
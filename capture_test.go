@@ -0,0 +1,144 @@
+package ohm
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func captureAs(name string, expr PExpr) PExpr {
+	return &Capture{name: name, expr: expr}
+}
+
+func backref(name string) PExpr {
+	return &BackReference{name: name}
+}
+
+func captureGrammar() *Grammar {
+	return grammar(map[string]PExpr{
+		// <<TAG ... TAG
+		"heredoc": seq(
+			lit("<<"), captureAs("tag", &Plus{apply("upper")}), lit("\n"),
+			&Star{seq(&Not{seq(lit("\n"), backref("tag"))}, &Any{})},
+			lit("\n"), backref("tag"),
+		),
+		// r#"..."#, with any number of #s
+		"raw": seq(
+			lit("r"), captureAs("hashes", &Star{lit("#")}), lit("\""),
+			&Star{seq(&Not{seq(lit("\""), backref("hashes"))}, &Any{})},
+			lit("\""), backref("hashes"),
+		),
+		"undone": alt(
+			seq(captureAs("x", lit("a")), lit("!")),
+			seq(captureAs("y", lit("a")), backref("x")),
+		),
+		"outer":     seq(captureAs("x", lit("a")), apply("inner")),
+		"inner":     backref("x"),
+		"returned":  seq(apply("captures"), backref("x")),
+		"captures":  captureAs("x", lit("b")),
+		"lookahead": seq(&Lookahead{captureAs("x", lit("a"))}, backref("x")),
+		"last":      seq(captureAs("x", lit("a")), captureAs("x", lit("b")), backref("x")),
+		"Words":     seq(captureAs("w", apply("word")), backref("w")),
+		"word":      &Plus{apply("lower")},
+	})
+}
+
+func TestCapture(t *testing.T) {
+	g := captureGrammar()
+	tests := []struct {
+		rule    string
+		input   string
+		matches bool
+	}{
+		{"heredoc", "<<EOF\nhello\nEOF", true},
+		{"heredoc", "<<EOF\nEO\nxEOF\nEOF", true},
+		{"heredoc", "<<EOF\nhello\nEND", false},
+		{"heredoc", "<<EOF\nhello\nEOF\n", false},
+		{"heredoc", "<<EOF\nhello\nEOFX", false},
+		{"raw", `r"abc"`, true},
+		{"raw", `r#"a"b"#`, true},
+		{"raw", `r##"a"#b"##`, true},
+		{"raw", `r#"a"##`, false},
+		{"raw", `r##"a"#`, false},
+		{"undone", "a!", true},
+		{"undone", "aa", false},
+		{"outer", "aa", false},
+		{"returned", "bb", false},
+		{"lookahead", "a", false},
+		{"last", "abb", true},
+		{"last", "aba", false},
+		{"Words", "go go", true},
+		{"Words", "go gone", false},
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		for _, test := range tests {
+			res, err := g.MatchesRule(test.rule, test.input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res != test.matches {
+				t.Errorf("%s: rule=%s input=%q expected=%v actual=%v", names[i], test.rule, test.input, test.matches, res)
+			}
+		}
+	}
+}
+
+// TestCaptureMemo checks that memoized results agree with matching without
+// memoization when rules with captures are applied while backtracking.
+func TestCaptureMemo(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start": &Star{alt(
+			seq(captureAs("x", apply("item")), lit("="), backref("x")),
+			seq(captureAs("x", apply("item")), lit("~"), apply("item")),
+			apply("item"),
+		)},
+		"item": alt(
+			seq(captureAs("y", &Plus{lit("a")}), lit("b"), backref("y")),
+			lit("b"),
+		),
+	})
+	never := g.WithMemoConfig(MemoConfig{Default: MemoNever})
+
+	r := rand.New(rand.NewSource(1))
+	names, grammars := variants(g)
+	for j := 0; j < 300; j++ {
+		var input []byte
+		for k := r.Intn(10); k >= 0; k-- {
+			input = append(input, "ab=~"[r.Intn(4)])
+		}
+
+		expected, err := never.MatchesRule("start", string(input))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for i, g := range grammars {
+			res, err := g.MatchesRule("start", string(input))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res != expected {
+				t.Errorf("%s: input=%q expected=%v actual=%v", names[i], input, expected, res)
+			}
+		}
+	}
+}
+
+func TestCaptureTokens(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"Same": seq(captureAs("x", &TokenMatch{kind: "IDENT"}), &TokenMatch{kind: "+"}, backref("x")),
+	})
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		for input, expected := range map[string]bool{"a + a": true, "a + b": false, "a + 1": false} {
+			res, err := g.MatchTokens("Same", scanGo(t, input))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res.Succeeded() != expected {
+				t.Errorf("%s: input=%q expected=%v actual=%v", names[i], input, expected, res.Succeeded())
+			}
+		}
+	}
+}
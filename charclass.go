@@ -0,0 +1,179 @@
+package ohm
+
+import (
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+type runeRange struct {
+	lo rune
+	hi rune
+}
+
+// CharClass matches a single rune from a set. ASCII runes are looked up in a
+// bitset, everything else is found with a binary search over sorted,
+// non-overlapping ranges.
+type CharClass struct {
+	ascii  [2]uint64
+	ranges []runeRange
+}
+
+func (c *CharClass) contains(r rune) bool {
+	if r < utf8.RuneSelf {
+		return c.ascii[r>>6]&(1<<(r&63)) != 0
+	}
+
+	i := sort.Search(len(c.ranges), func(i int) bool {
+		return c.ranges[i].hi >= r
+	})
+	return i < len(c.ranges) && c.ranges[i].lo <= r
+}
+
+func (c *CharClass) Eval(m *MatchState) (bool, error) {
+	r, size, err := m.in.peek(m.pos)
+	if err != nil || size == 0 {
+		return false, err
+	}
+
+	if !c.contains(r) {
+		return false, nil
+	}
+
+	m.pos += size
+	return true, nil
+}
+
+func (c *CharClass) substituteParams(args []PExpr) (PExpr, error) {
+	return c, nil
+}
+
+// primitiveClass returns a CharClass equivalent to one of the single-rune
+// primitives, or nil if expr isn't one.
+func primitiveClass(expr PExpr) *CharClass {
+	var b classBuilder
+
+	switch e := expr.(type) {
+	case *CharClass:
+		return e
+	case *Char:
+		b.addRange(e.r, e.r)
+	case *Chars:
+		for _, r := range e.runes {
+			b.addRange(r, r)
+		}
+	case *Range:
+		b.addRange(e.start, e.end)
+	case *UnicodeCategories:
+		switch e.kind {
+		case ucTypeLower:
+			b.addTable(unicode.Lower)
+		case ucTypeUpper:
+			b.addTable(unicode.Upper)
+		case ucTypeRanges:
+			for _, t := range e.ranges {
+				b.addTable(t)
+			}
+		}
+	default:
+		return nil
+	}
+
+	return b.class()
+}
+
+// classBuilder accumulates runes and ranges and produces a normalized
+// CharClass.
+type classBuilder struct {
+	ascii  [2]uint64
+	ranges []runeRange
+}
+
+func (b *classBuilder) addRange(lo, hi rune) {
+	for ; lo <= hi && lo < utf8.RuneSelf; lo++ {
+		b.ascii[lo>>6] |= 1 << (lo & 63)
+	}
+	if lo <= hi {
+		b.ranges = append(b.ranges, runeRange{lo, hi})
+	}
+}
+
+func (b *classBuilder) addTable(t *unicode.RangeTable) {
+	for _, r := range t.R16 {
+		b.addStrided(rune(r.Lo), rune(r.Hi), rune(r.Stride))
+	}
+	for _, r := range t.R32 {
+		b.addStrided(rune(r.Lo), rune(r.Hi), rune(r.Stride))
+	}
+}
+
+func (b *classBuilder) addStrided(lo, hi, stride rune) {
+	if stride == 1 {
+		b.addRange(lo, hi)
+		return
+	}
+	for r := lo; r <= hi; r += stride {
+		b.addRange(r, r)
+	}
+}
+
+func (b *classBuilder) addClass(c *CharClass) {
+	b.ascii[0] |= c.ascii[0]
+	b.ascii[1] |= c.ascii[1]
+	b.ranges = append(b.ranges, c.ranges...)
+}
+
+// subtract removes every rune in c from the builder.
+func (b *classBuilder) subtract(c *CharClass) {
+	b.ascii[0] &^= c.ascii[0]
+	b.ascii[1] &^= c.ascii[1]
+
+	var ranges []runeRange
+	for _, r := range normalizeRanges(b.ranges) {
+		for _, s := range c.ranges {
+			if s.hi < r.lo || s.lo > r.hi {
+				continue
+			}
+			if s.lo > r.lo {
+				ranges = append(ranges, runeRange{r.lo, s.lo - 1})
+			}
+			r.lo = s.hi + 1
+			if r.lo > r.hi {
+				break
+			}
+		}
+		if r.lo <= r.hi {
+			ranges = append(ranges, r)
+		}
+	}
+	b.ranges = ranges
+}
+
+func (b *classBuilder) class() *CharClass {
+	return &CharClass{ascii: b.ascii, ranges: normalizeRanges(b.ranges)}
+}
+
+func normalizeRanges(ranges []runeRange) []runeRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	sorted := make([]runeRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].lo < sorted[j].lo
+	})
+
+	merged := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.lo <= last.hi+1 {
+			if r.hi > last.hi {
+				last.hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
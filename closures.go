@@ -0,0 +1,667 @@
+package ohm
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+type matchFunc func(m *MatchState) (bool, error)
+
+// closureProgram is a grammar compiled into Go closures. Each rule
+// instantiation gets a slot, and applications call their slot directly
+// instead of looking the rule up by name.
+type closureProgram struct {
+	g     *Grammar
+	slots []matchFunc
+	names []string
+
+	// memoDecisions is like Program's.
+	memoDecisions []memoDecision
+
+	// starts and prefixes match each rule, followed by the end of the input
+	// or not.
+	starts   map[string]matchFunc
+	prefixes map[string]matchFunc
+}
+
+func (g *Grammar) compileClosures() (*closureProgram, error) {
+	c := &closureCompiler{in: newInstantiator(g)}
+	p := &closureProgram{g: g, starts: make(map[string]matchFunc), prefixes: make(map[string]matchFunc)}
+	c.p = p
+
+	seen := make(map[string]bool)
+	for sg := g; sg != nil; sg = sg.super {
+		for name := range sg.rules {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			islex, err := (&Apply{name: name}).isLexical()
+			if err != nil {
+				continue
+			}
+
+			if p.starts[name], err = c.gen(startBody(name, false), islex); err != nil {
+				return nil, err
+			}
+			if p.prefixes[name], err = c.gen(startBody(name, true), islex); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i := 0; i < len(c.in.insts); i++ {
+		inst := c.in.insts[i]
+		p.names = append(p.names, inst.name)
+
+		if inst.err != nil {
+			err := inst.err
+			p.slots = append(p.slots, func(m *MatchState) (bool, error) {
+				return false, err
+			})
+			continue
+		}
+
+		f, err := c.gen(inst.body, inst.lexical)
+		if err != nil {
+			return nil, err
+		}
+		p.slots = append(p.slots, f)
+	}
+
+	p.memoDecisions = decideAll(g.memoRules, p.names)
+	return p, nil
+}
+
+func (p *closureProgram) match(name string, in *inputBuffer, opts MatchOptions) (*MatchResult, error) {
+	a := Apply{name: name}
+	if _, err := a.isLexical(); err != nil {
+		return nil, err
+	}
+
+	starts := p.starts
+	if opts.Prefix {
+		starts = p.prefixes
+	}
+	f, ok := starts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rule \"%s\"", name)
+	}
+
+	m := newMatchState(p.g, in, &opts)
+	defer m.free()
+	m.stack = append(m.stack, call{app: &Apply{}})
+	m.memoDecisions = p.memoDecisions
+	if opts.Memo != nil {
+		m.memoDecisions = decideAll(m.memoRules, p.names)
+	}
+
+	res, err := f(m)
+	if err != nil {
+		return nil, err
+	}
+	return m.result(res), nil
+}
+
+type closureCompiler struct {
+	p  *closureProgram
+	in *instantiator
+}
+
+// gen compiles expr evaluated in a lexical or syntactic context. The
+// returned function behaves like MatchState.eval: it skips spaces first in a
+// syntactic context and restores the position, indentation, captures and
+// diagnostics on failure.
+func (c *closureCompiler) gen(expr PExpr, lexical bool) (matchFunc, error) {
+	body, err := c.genBody(expr, lexical)
+	if err != nil {
+		return nil, err
+	}
+
+	if lexical {
+		switch expr.(type) {
+		case *Any, *Char, *Chars, *Range, *UnicodeCategories, *CharClass, *ByteRange, *TokenMatch, *Indentation, *Native, *BackReference, *Apply:
+			// These never move on failure.
+			return body, nil
+		}
+
+		return func(m *MatchState) (bool, error) {
+			pos, indent, captures, diagnostics := m.pos, m.indent, len(m.captures), len(m.diagnostics)
+			res, err := body(m)
+			if err != nil || !res {
+				m.pos, m.indent, m.captures = pos, indent, m.captures[:captures]
+				m.diagnostics = m.diagnostics[:diagnostics]
+			}
+			return res, err
+		}, nil
+	}
+
+	skip, err := c.genApply(&spaces)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(m *MatchState) (bool, error) {
+		pos, indent, captures, diagnostics := m.pos, m.indent, len(m.captures), len(m.diagnostics)
+		if end, ok := m.skips.lookup(pos); ok {
+			m.pos = end
+		} else if res, err := try(m, skip); err != nil {
+			return false, err
+		} else if !res {
+			m.pos = pos
+			m.skips.store(pos, pos)
+		} else {
+			m.skips.store(pos, m.pos)
+		}
+
+		res, err := body(m)
+		if err != nil || !res {
+			m.pos, m.indent, m.captures = pos, indent, m.captures[:captures]
+			m.diagnostics = m.diagnostics[:diagnostics]
+		}
+		return res, err
+	}, nil
+}
+
+func (c *closureCompiler) genAll(exprs []PExpr, lexical bool) ([]matchFunc, error) {
+	fs := make([]matchFunc, len(exprs))
+	for i, expr := range exprs {
+		f, err := c.gen(expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		fs[i] = f
+	}
+	return fs, nil
+}
+
+func (c *closureCompiler) genBody(expr PExpr, lexical bool) (matchFunc, error) {
+	switch e := expr.(type) {
+	case *Any:
+		return genRune(func(r rune) bool { return true }), nil
+	case *Char:
+		want := e.r
+		return genRune(func(r rune) bool { return r == want }), nil
+	case *Chars, *Range, *UnicodeCategories, *CharClass:
+		return genRune(primitiveClass(e).contains), nil
+	case *ByteRange:
+		lo, hi := e.start, e.end
+		return func(m *MatchState) (bool, error) {
+			b, ok, err := m.in.peekByte(m.pos)
+			if err != nil || !ok || b < lo || b > hi {
+				return false, err
+			}
+			m.pos++
+			return true, nil
+		}, nil
+	case *TokenMatch:
+		return func(m *MatchState) (bool, error) {
+			tok, ok := m.in.token(m.pos)
+			if !ok || !e.matches(tok) {
+				return false, nil
+			}
+			m.pos++
+			return true, nil
+		}, nil
+	case *Indentation, *Native:
+		return e.Eval, nil
+	case *SemanticPredicate:
+		f, err := c.gen(e.expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *MatchState) (bool, error) {
+			// See SemanticPredicate.Eval.
+			start := m.pos
+			m.choices++
+			m.preds++
+			res, err := f(m)
+			m.choices--
+			m.preds--
+			if err != nil || !res {
+				return false, err
+			}
+			return e.check(m.in, start, m.pos)
+		}, nil
+	case *Capture:
+		f, err := c.gen(e.expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *MatchState) (bool, error) {
+			// See Capture.Eval.
+			start := m.pos
+			m.choices++
+			m.preds++
+			res, err := f(m)
+			m.choices--
+			m.preds--
+			if err != nil || !res {
+				return false, err
+			}
+
+			captured, err := newCapture(m.in, e.name, start, m.pos)
+			if err != nil {
+				return false, err
+			}
+			m.captures = append(m.captures, captured)
+			return true, nil
+		}, nil
+	case *BackReference:
+		return e.Eval, nil
+	case *Recover:
+		f, err := c.gen(e.expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		sync, err := c.gen(e.sync, lexical)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *MatchState) (bool, error) {
+			// See Recover.Eval.
+			start, cut := m.pos, m.cut
+			m.choices++
+			m.preds++
+			res, err := f(m)
+			m.choices--
+			m.preds--
+			m.cut = cut
+			if err != nil || res {
+				return res, err
+			}
+			return e.recover(m, start, sync)
+		}, nil
+	case *Alt:
+		return c.genAlt(e.exprs, lexical)
+	case *DispatchAlt:
+		return c.genDispatchAlt(e, lexical)
+	case *Seq:
+		fs, err := c.genAll(e.exprs, lexical)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *MatchState) (bool, error) {
+			for _, f := range fs {
+				res, err := f(m)
+				if err != nil || !res {
+					return false, err
+				}
+			}
+			return true, nil
+		}, nil
+	case *Maybe:
+		f, err := c.gen(e.expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *MatchState) (bool, error) {
+			start := m.pos
+			res, err := try(m, f)
+			if err != nil {
+				return false, err
+			}
+			return res || !m.cutPast(start), nil
+		}, nil
+	case *Star:
+		f, err := c.gen(e.expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		return genStar(f), nil
+	case *Plus:
+		f, err := c.gen(e.expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		star := genStar(f)
+		return func(m *MatchState) (bool, error) {
+			res, err := f(m)
+			if err != nil || !res {
+				return res, err
+			}
+			m.settle()
+			return star(m)
+		}, nil
+	case *Repeat:
+		if err := e.checkBounds(); err != nil {
+			return func(m *MatchState) (bool, error) {
+				return false, err
+			}, nil
+		}
+		f, err := c.gen(e.expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		return genRepeat(f, e.min, e.max), nil
+	case *Lookahead:
+		f, err := c.gen(e.expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		return genPredicate(f), nil
+	case *Not:
+		f, err := c.gen(e.expr, lexical)
+		if err != nil {
+			return nil, err
+		}
+		pred := genPredicate(f)
+		return func(m *MatchState) (bool, error) {
+			res, err := pred(m)
+			return !res && err == nil, err
+		}, nil
+	case *Cut:
+		return func(m *MatchState) (bool, error) {
+			m.cutAt(m.pos)
+			return true, nil
+		}, nil
+	case *Apply:
+		return c.genApply(e)
+	case *Param:
+		// Bodies are compiled with their arguments substituted, so a
+		// remaining parameter has no argument to refer to.
+		err := fmt.Errorf("param index out of range: %d", e.idx)
+		return func(m *MatchState) (bool, error) {
+			return false, err
+		}, nil
+	default:
+		// Fall back to the interpreter for expressions we don't know about.
+		return func(m *MatchState) (bool, error) {
+			if m.fallback == nil {
+				m.fallback = &MatchState{
+					g:         m.g,
+					in:        m.in,
+					memo:      &memoTable{},
+					memoRules: m.memoRules,
+					profile:   m.profile,
+					limits:    m.limits,
+				}
+			}
+
+			f := m.fallback
+			f.pos = m.pos
+			f.indent = m.memo.indents.move(m.indent, &f.memo.indents)
+			f.captures = append(f.captures[:0], m.captures[m.captureBase:]...)
+			f.diagnostics = f.diagnostics[:0]
+			f.stack = []call{{app: &Apply{}, lexical: lexical}}
+			res, err := e.Eval(f)
+			if err == nil && res {
+				m.pos = f.pos
+				m.indent = f.memo.indents.move(f.indent, &m.memo.indents)
+				m.captures = append(m.captures[:m.captureBase], f.captures...)
+				m.diagnostics = append(m.diagnostics, f.diagnostics...)
+			}
+			return res, err
+		}, nil
+	}
+}
+
+func genRune(match func(r rune) bool) matchFunc {
+	return func(m *MatchState) (bool, error) {
+		r, size, err := m.in.peek(m.pos)
+		if err != nil || size == 0 {
+			return false, err
+		}
+
+		if !match(r) {
+			return false, nil
+		}
+		m.pos += size
+		return true, nil
+	}
+}
+
+func genStar(f matchFunc) matchFunc {
+	return func(m *MatchState) (bool, error) {
+		for {
+			start := m.pos
+			res, err := try(m, f)
+			if err != nil {
+				return false, err
+			}
+			if !res {
+				return !m.cutPast(start), nil
+			}
+			m.settle()
+			if err := m.step(); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// genRepeat is like Repeat.Eval.
+func genRepeat(f matchFunc, min, max int) matchFunc {
+	star := genStar(f)
+	return func(m *MatchState) (bool, error) {
+		for i := 0; i < min; i++ {
+			res, err := f(m)
+			if err != nil || !res {
+				return res, err
+			}
+			m.settle()
+			if err := m.step(); err != nil {
+				return false, err
+			}
+		}
+		if max < 0 {
+			return star(m)
+		}
+
+		for i := min; i < max; i++ {
+			start := m.pos
+			res, err := try(m, f)
+			if err != nil {
+				return false, err
+			}
+			if !res {
+				return !m.cutPast(start), nil
+			}
+			m.settle()
+			if err := m.step(); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// genPredicate is like MatchState.predicate.
+func genPredicate(f matchFunc) matchFunc {
+	return func(m *MatchState) (bool, error) {
+		pos, indent, captures, cut := m.pos, m.indent, len(m.captures), m.cut
+		diagnostics := len(m.diagnostics)
+		m.choices++
+		m.preds++
+
+		res, err := f(m)
+
+		m.choices--
+		m.preds--
+		m.pos, m.indent, m.captures, m.cut = pos, indent, m.captures[:captures], cut
+		m.diagnostics = m.diagnostics[:diagnostics]
+		return res, err
+	}
+}
+
+// try is like MatchState.try.
+func try(m *MatchState, f matchFunc) (bool, error) {
+	m.choices++
+	res, err := f(m)
+	m.choices--
+	return res, err
+}
+
+func (c *closureCompiler) genAlt(exprs []PExpr, lexical bool) (matchFunc, error) {
+	fs, err := c.genAll(exprs, lexical)
+	if err != nil {
+		return nil, err
+	}
+
+	last := len(fs) - 1
+	return func(m *MatchState) (bool, error) {
+		start := m.pos
+		for i, f := range fs {
+			var res bool
+			var err error
+			if i < last {
+				res, err = try(m, f)
+			} else {
+				res, err = f(m)
+			}
+			if err != nil || res {
+				return res, err
+			}
+			if m.cutPast(start) {
+				return false, nil
+			}
+		}
+		return false, nil
+	}, nil
+}
+
+// genDispatchAlt compiles a DispatchAlt into a jump on the next rune to the
+// alternatives that might match it. In a context other than the one the
+// table was built for, every alternative is tried, like an Alt.
+func (c *closureCompiler) genDispatchAlt(a *DispatchAlt, lexical bool) (matchFunc, error) {
+	if lexical != a.table.lexical {
+		return c.genAlt(a.exprs, lexical)
+	}
+
+	fs, err := c.genAll(a.exprs, lexical)
+	if err != nil {
+		return nil, err
+	}
+
+	// Runes with the same candidates share a list.
+	lists := make(map[uint64][]matchFunc)
+	candidates := func(mask uint64) []matchFunc {
+		if list, ok := lists[mask]; ok {
+			return list
+		}
+		var list []matchFunc
+		for i, f := range fs {
+			if mask&(1<<i) != 0 {
+				list = append(list, f)
+			}
+		}
+		lists[mask] = list
+		return list
+	}
+
+	t := a.table
+	var ascii [utf8.RuneSelf][]matchFunc
+	for r, mask := range t.ascii {
+		ascii[r] = candidates(mask)
+	}
+	eof := candidates(t.eof)
+
+	return func(m *MatchState) (bool, error) {
+		// In a syntactic context, gen has already skipped spaces, and
+		// other runes are checked against the table's classes below.
+		list, mask := fs, ^uint64(0)
+		r, size, err := m.in.peek(m.pos)
+		switch {
+		case err != nil:
+			// Let the alternatives report the error.
+		case size == 0:
+			list = eof
+		case r < utf8.RuneSelf:
+			list = ascii[r]
+		default:
+			mask = t.always
+			for i, c := range t.classes {
+				if c != nil && c.contains(r) {
+					mask |= 1 << i
+				}
+			}
+		}
+
+		start := m.pos
+		last := len(list) - 1
+		for i, f := range list {
+			if mask&(1<<i) == 0 {
+				continue
+			}
+			var res bool
+			var err error
+			if i < last {
+				res, err = try(m, f)
+			} else {
+				res, err = f(m)
+			}
+			if err != nil || res {
+				return res, err
+			}
+			if m.cutPast(start) {
+				return false, nil
+			}
+		}
+		return false, nil
+	}, nil
+}
+
+func (c *closureCompiler) genApply(a *Apply) (matchFunc, error) {
+	i, err := c.in.instantiate(a)
+	if err != nil {
+		return nil, err
+	}
+
+	p := c.p
+	id := int32(i)
+	return func(m *MatchState) (bool, error) {
+		if m.limits != nil {
+			if err := m.limits.step(m.pos); err != nil {
+				return false, err
+			}
+		}
+
+		memoize := m.memoDecisions == nil || m.memoDecisions[i] == memoYes
+		if memoize {
+			e, ok := m.memo.get(id, m.pos, m.indent)
+			if m.profile != nil {
+				m.profile.record(p.names[i], ok)
+			}
+			if ok {
+				m.replay(e)
+				return e.res, nil
+			}
+		}
+
+		start, indent, diagnostics := m.pos, m.indent, len(m.diagnostics)
+		if m.limits != nil {
+			if err := m.limits.enter(start); err != nil {
+				return false, err
+			}
+		}
+		examined := m.in.enter(start)
+		captureBase := m.captureBase
+		m.captureBase = len(m.captures)
+		res, err := p.slots[i](m)
+		if err != nil {
+			return false, err
+		}
+		m.captures = m.captures[:m.captureBase]
+		m.captureBase = captureBase
+		if m.limits != nil {
+			m.limits.exit()
+		}
+		if !res {
+			m.pos, m.indent = start, indent
+		}
+
+		e := memoEntry{id: id, res: res, cut: m.cutPast(start), end: m.pos}
+		m.in.exit(examined, &e)
+		if memoize && m.memo.indented(&e, indent, m.indent) {
+			m.memo.set(start, e)
+			m.memo.diagnose(start, id, m.diagnostics[diagnostics:])
+			if m.limits != nil {
+				if err := m.limits.memoized(m.memo, start); err != nil {
+					return false, err
+				}
+			}
+		}
+		return res, nil
+	}, nil
+}
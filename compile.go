@@ -0,0 +1,171 @@
+package ohm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxInstantiations bounds the number of distinct (rule, arguments) pairs a
+// grammar can be compiled into. Parameterized rules that pass ever-growing
+// arguments to themselves would otherwise never finish compiling.
+const maxInstantiations = 10000
+
+// maxArgsKeyLen bounds the size of the arguments of an instantiation, for the
+// same reason.
+const maxArgsKeyLen = 1 << 12
+
+// instantiation is a rule together with the arguments it's applied to. Each
+// one is compiled separately, so compiled code never has to substitute
+// parameters at match time.
+type instantiation struct {
+	name    string
+	body    PExpr
+	lexical bool
+	err     error
+}
+
+// instantiator assigns an index to every instantiation reachable from a
+// grammar. Backends compile instantiations in the order they're assigned.
+type instantiator struct {
+	g     *Grammar
+	index map[string]int
+	insts []*instantiation
+}
+
+func newInstantiator(g *Grammar) *instantiator {
+	return &instantiator{g: g, index: make(map[string]int)}
+}
+
+func (in *instantiator) lookup(name string) PExpr {
+	for g := in.g; g != nil; g = g.super {
+		if expr := g.rules[name]; expr != nil {
+			return expr
+		}
+	}
+	return nil
+}
+
+// instantiate returns the index of the instantiation for a, adding it if
+// it hasn't been seen before. a's arguments must not contain parameters.
+func (in *instantiator) instantiate(a *Apply) (int, error) {
+	key, ok := exprKey(a, maxArgsKeyLen)
+	if !ok {
+		return 0, fmt.Errorf("arguments to \"%s\" are too large", a.name)
+	}
+	if i, ok := in.index[key]; ok {
+		return i, nil
+	}
+	if len(in.insts) >= maxInstantiations {
+		return 0, fmt.Errorf("too many instantiations of parameterized rules")
+	}
+
+	inst := &instantiation{name: a.name}
+
+	islex, err := a.isLexical()
+	if err != nil {
+		inst.err = err
+	} else if body := in.lookup(a.name); body == nil {
+		inst.err = fmt.Errorf("unknown rule \"%s\"", a.name)
+	} else if body, err = body.substituteParams(a.args); err != nil {
+		inst.err = err
+	} else {
+		inst.body = body
+		inst.lexical = islex
+	}
+
+	i := len(in.insts)
+	in.index[key] = i
+	in.insts = append(in.insts, inst)
+	return i, nil
+}
+
+// exprKey returns a string that's equal for structurally equal expressions,
+// or false if the string would be longer than max. Expressions this function
+// doesn't know about are only equal to themselves.
+func exprKey(expr PExpr, max int) (string, bool) {
+	var sb strings.Builder
+	writeExprKey(&sb, expr, max)
+	if sb.Len() > max {
+		return "", false
+	}
+	return sb.String(), true
+}
+
+func writeExprKey(sb *strings.Builder, expr PExpr, max int) {
+	if sb.Len() > max {
+		return
+	}
+
+	writeList := func(op string, exprs []PExpr) {
+		sb.WriteString(op)
+		sb.WriteByte('(')
+		for i, e := range exprs {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			writeExprKey(sb, e, max)
+		}
+		sb.WriteByte(')')
+	}
+
+	switch e := expr.(type) {
+	case *Any:
+		sb.WriteString("any")
+	case *Char:
+		sb.WriteString(strconv.QuoteRune(e.r))
+	case *Chars:
+		sb.WriteString(strconv.Quote(string(e.runes)))
+		sb.WriteString("[]")
+	case *Range:
+		fmt.Fprintf(sb, "%q..%q", e.start, e.end)
+	case *ByteRange:
+		fmt.Fprintf(sb, "byte(%d..%d)", e.start, e.end)
+	case *TokenMatch:
+		fmt.Fprintf(sb, "token(%q %q)", e.kind, e.value)
+	case *Indentation:
+		if e.dedent {
+			sb.WriteString("dedent")
+		} else {
+			sb.WriteString("indent")
+		}
+	case *Alt:
+		writeList("|", e.exprs)
+	case *DispatchAlt:
+		writeList("|", e.exprs)
+	case *Seq:
+		writeList("", e.exprs)
+	case *Maybe:
+		writeList("?", []PExpr{e.expr})
+	case *Star:
+		writeList("*", []PExpr{e.expr})
+	case *Plus:
+		writeList("+", []PExpr{e.expr})
+	case *Repeat:
+		writeList(fmt.Sprintf("{%d,%d}", e.min, e.max), []PExpr{e.expr})
+	case *Lookahead:
+		writeList("&", []PExpr{e.expr})
+	case *Not:
+		writeList("~", []PExpr{e.expr})
+	case *Cut:
+		sb.WriteString("cut")
+	case *SemanticPredicate:
+		writeList("pred:"+e.name, []PExpr{e.expr})
+	case *Capture:
+		writeList("capture:"+e.name, []PExpr{e.expr})
+	case *BackReference:
+		sb.WriteString("backref:" + e.name)
+	case *Recover:
+		op := "recover:"
+		if e.bytes {
+			op = "recoverBytes:"
+		}
+		writeList(op+e.name, []PExpr{e.expr, e.sync})
+	case *Param:
+		fmt.Fprintf(sb, "$%d", e.idx)
+	case *Apply:
+		writeList(e.name, e.args)
+	default:
+		fmt.Fprintf(sb, "%T(%p)", e, e)
+	}
+}
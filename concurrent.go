@@ -0,0 +1,98 @@
+package ohm
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Finished MatchStates and machines are pooled, so matching many inputs
+// reuses their stacks and memo tables instead of allocating new ones.
+var (
+	statePool   = sync.Pool{New: func() any { return &MatchState{} }}
+	machinePool = sync.Pool{New: func() any { return &machine{} }}
+)
+
+// newMatchState returns a pooled MatchState for matching in with g,
+// configured by opts, with an empty stack.
+func newMatchState(g *Grammar, in *inputBuffer, opts *MatchOptions) *MatchState {
+	m := statePool.Get().(*MatchState)
+	m.g = g
+	m.in = in
+	m.in.invalid = opts.InvalidUTF8
+	m.pos = opts.start
+	m.memo = opts.memoTable(&m.spare)
+	opts.setup(m)
+	return m
+}
+
+// free returns m to the pool. Results must be built before calling it.
+func (m *MatchState) free() {
+	*m = MatchState{stack: m.stack[:0], captures: m.captures[:0], diagnostics: m.diagnostics[:0], spare: m.spare}
+	statePool.Put(m)
+}
+
+// free returns vm to the pool.
+func (vm *machine) free() {
+	*vm = machine{stack: vm.stack[:0], captures: vm.captures[:0], diagnostics: vm.diagnostics[:0], spare: vm.spare}
+	machinePool.Put(vm)
+}
+
+// MatchAll matches each of inputs against the rule called name, followed by
+// the end of the input, using up to workers goroutines, or GOMAXPROCS if
+// workers isn't positive. Results are in the same order as inputs. The first
+// error stops the remaining matches and is returned along with the index of
+// its input.
+//
+// A Grammar can also be matched from several goroutines directly. It's never
+// modified by matching.
+func (g *Grammar) MatchAll(ctx context.Context, inputs []string, name string, workers int) ([]*MatchResult, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(inputs))
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*MatchResult, len(inputs))
+	var next atomic.Int64
+	var once sync.Once
+	var firstErr error
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				i := int(next.Add(1)) - 1
+				if i >= len(inputs) {
+					return
+				}
+
+				res, err := g.MatchWithOptions(name, inputs[i], MatchOptions{Context: ctx})
+				if err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("input %d: %w", i, err)
+						cancel()
+					})
+					return
+				}
+				results[i] = res
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,104 @@
+package ohm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Run with -race to check that matching doesn't modify grammars.
+func TestConcurrentMatch(t *testing.T) {
+	inputs := []string{
+		ohmGrammarSource,
+		"G { start = \"a\" | b\n b = \"c\"* }",
+		"G { start = }",
+		"G <: H { x += y }",
+	}
+
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		g = g.WithMemoConfig(MemoConfig{Default: MemoAuto})
+
+		expected := make([]bool, len(inputs))
+		for j, input := range inputs {
+			res, err := g.MatchesRule("Grammars", input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			expected[j] = res
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 2*len(inputs); j++ {
+					input := inputs[(w+j)%len(inputs)]
+					res, err := g.MatchWithOptions("Grammars", input, MatchOptions{ProfileMemo: true, LongestPrefix: true})
+					if err != nil {
+						t.Errorf("%s: unexpected error: %s", names[i], err)
+						return
+					}
+					if res.Succeeded() != expected[(w+j)%len(inputs)] {
+						t.Errorf("%s: input=%q expected=%v actual=%v", names[i], input, expected[(w+j)%len(inputs)], res.Succeeded())
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestMatchAll(t *testing.T) {
+	var inputs []string
+	for i := 0; i < 100; i++ {
+		inputs = append(inputs, fmt.Sprintf("G%d { start = %s }", i, strings.Repeat("\"x\" ", i%7)))
+	}
+	inputs[42] = "G { start = "
+
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		for _, workers := range []int{0, 1, 3} {
+			results, err := g.MatchAll(context.Background(), inputs, "Grammars", workers)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if len(results) != len(inputs) {
+				t.Fatalf("%s: expected %d results, got %d", names[i], len(inputs), len(results))
+			}
+			for j, res := range results {
+				if res.Succeeded() != (j != 42) || res.Input() != inputs[j] {
+					t.Errorf("%s: workers=%d input %d: unexpected result %v for %q", names[i], workers, j, res.Succeeded(), res.Input())
+				}
+			}
+		}
+	}
+}
+
+func TestMatchAllErrors(t *testing.T) {
+	inputs := []string{"G {}", "G {}", "G \xff {}", "G {}"}
+
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		_, err := g.MatchAll(context.Background(), inputs, "Grammars", 2)
+		if err == nil || !strings.HasPrefix(err.Error(), "input 2: ") {
+			t.Errorf("%s: expected an error for input 2, got %v", names[i], err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = g.MatchAll(ctx, inputs, "Grammars", 2)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected=%v actual=%v", names[i], context.Canceled, err)
+		}
+
+		results, err := g.MatchAll(context.Background(), nil, "Grammars", 2)
+		if err != nil || len(results) != 0 {
+			t.Errorf("%s: expected no results, got %v %v", names[i], results, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package ohm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCut(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start": alt(seq(lit("a"), &Cut{}, lit("b")), lit("ac")),
+	})
+
+	tests := []test{
+		{"ab", true},
+		{"ac", false},
+	}
+	testMatchesRule(t, g, "start", tests)
+}
+
+func TestCutInRepetition(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start": seq(&Star{seq(lit("a"), &Cut{}, lit("b"))}, maybe(lit("ac"))),
+	})
+
+	tests := []test{
+		{"abab", true},
+		{"abac", false},
+		{"", true},
+	}
+	testMatchesRule(t, g, "start", tests)
+}
+
+func TestCutInLookahead(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start": alt(
+			seq(&Lookahead{seq(lit("a"), &Cut{})}, lit("ab")),
+			seq(&Not{seq(lit("a"), &Cut{}, lit("b"))}, lit("x")),
+			lit("ac"),
+		),
+	})
+
+	tests := []test{
+		{"ab", true},
+		{"x", true},
+		{"ac", true},
+	}
+	testMatchesRule(t, g, "start", tests)
+}
+
+func TestMemoizedCut(t *testing.T) {
+	// The lookahead memoizes cutA without its cut taking effect. Applying it
+	// again has to cut, even though the result comes from the memo table.
+	g := grammar(map[string]PExpr{
+		"start": alt(seq(&Lookahead{apply("cutA")}, apply("cutA"), lit("x")), lit("ay")),
+		"cutA":  seq(lit("a"), &Cut{}),
+	})
+
+	tests := []test{
+		{"ax", true},
+		{"ay", false},
+	}
+	testMatchesRule(t, g, "start", tests)
+}
+
+func TestReleaseMemo(t *testing.T) {
+	record := seq(apply("letter"), &Star{apply("alnum")}, lit(";"))
+	g := grammar(map[string]PExpr{
+		// Nothing can backtrack out of a top-level repetition.
+		"auto": &Star{apply("record")},
+
+		// Without the cut, the second alternative could be tried from the
+		// start.
+		"cut": alt(&Star{seq(apply("record"), &Cut{})}, lit("!")),
+
+		// Here the second alternative has to start from the beginning, so
+		// nothing can be released until it's being tried.
+		"backtrack": alt(seq(&Star{apply("record")}, lit("!")), &Star{apply("record")}),
+		"record":    record,
+	})
+	input := strings.Repeat("abc;", 5000)
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		for _, rule := range []string{"auto", "cut", "backtrack"} {
+			res, err := g.Match(rule, input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if !res.Succeeded() {
+				t.Errorf("%s %s: expected=true actual=false", names[i], rule)
+			}
+
+			stats := res.MemoStats()
+			if rule == "backtrack" {
+				continue
+			}
+			if live := stats.Entries - stats.Released; live > 10 {
+				t.Errorf("%s %s: expected a handful of live entries, got %d", names[i], rule, live)
+			}
+			if stats.Bytes > 1<<12 {
+				t.Errorf("%s %s: expected a small memo table, got %d bytes", names[i], rule, stats.Bytes)
+			}
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package ohm
+
+import "unicode/utf8"
+
+// firstSet describes which runes an expression can start with. It's an
+// over-approximation: if an expression succeeds, it either consumed nothing
+// (and nullable is true) or the first rune it consumed is in the set.
+type firstSet struct {
+	class    *CharClass
+	any      bool
+	nullable bool
+}
+
+var firstAll = firstSet{any: true, nullable: true}
+
+func (f firstSet) union(other firstSet) firstSet {
+	res := firstSet{any: f.any || other.any, nullable: f.nullable || other.nullable}
+	if res.any {
+		return res
+	}
+
+	switch {
+	case f.class == nil:
+		res.class = other.class
+	case other.class == nil:
+		res.class = f.class
+	default:
+		var b classBuilder
+		b.addClass(f.class)
+		b.addClass(other.class)
+		res.class = b.class()
+	}
+	return res
+}
+
+type firstKey struct {
+	rule    string
+	lexical bool
+}
+
+// first computes the first set of expr when evaluated in a lexical or
+// syntactic context. In a syntactic context, expr is assumed to start at a
+// position where spaces have already been skipped.
+func (o *optimizer) first(expr PExpr, lexical bool) firstSet {
+	switch e := expr.(type) {
+	case *Any:
+		return firstSet{any: true}
+	case *Char, *Chars, *Range, *UnicodeCategories, *CharClass:
+		return firstSet{class: o.class(e)}
+	case *ByteRange:
+		// Bytes below 0x80 are runes of their own, but others can start
+		// any rune.
+		if e.end < utf8.RuneSelf {
+			return firstSet{class: primitiveClass(&Range{rune(e.start), rune(e.end)})}
+		}
+		return firstSet{any: true}
+	case *TokenMatch:
+		return firstSet{any: true}
+	case *Alt:
+		var res firstSet
+		for _, expr := range e.exprs {
+			res = res.union(o.first(expr, lexical))
+		}
+		return res
+	case *Seq:
+		res := firstSet{nullable: true}
+		for _, expr := range e.exprs {
+			f := o.first(expr, lexical)
+			res = res.union(firstSet{class: f.class, any: f.any})
+			if !f.nullable {
+				res.nullable = false
+				break
+			}
+		}
+		return res
+	case *Maybe:
+		f := o.first(e.expr, lexical)
+		f.nullable = true
+		return f
+	case *Star:
+		f := o.first(e.expr, lexical)
+		f.nullable = true
+		return f
+	case *Plus:
+		return o.first(e.expr, lexical)
+	case *Repeat:
+		f := o.first(e.expr, lexical)
+		f.nullable = f.nullable || e.min == 0
+		return f
+	case *SemanticPredicate:
+		return o.first(e.expr, lexical)
+	case *Capture:
+		return o.first(e.expr, lexical)
+	case *Lookahead, *Not, *Cut, *Indentation:
+		return firstSet{nullable: true}
+	case *Apply:
+		return o.applyFirst(e, lexical)
+	default:
+		return firstAll
+	}
+}
+
+func (o *optimizer) applyFirst(a *Apply, lexical bool) firstSet {
+	islex, err := a.isLexical()
+	if err != nil {
+		return firstAll
+	}
+
+	f := o.ruleFirst(a, islex)
+
+	// A syntactic rule applied from a lexical context skips spaces before
+	// its body.
+	if lexical && !islex {
+		spaces := o.ruleFirst(&Apply{name: "spaces"}, true)
+		f = f.union(firstSet{class: spaces.class, any: spaces.any})
+	}
+	return f
+}
+
+func (o *optimizer) ruleFirst(a *Apply, lexical bool) firstSet {
+	key := firstKey{a.name, lexical}
+	if len(a.args) == 0 {
+		if f, ok := o.firsts[key]; ok {
+			return f
+		}
+	}
+	if o.firstVisiting[a.name] {
+		return firstAll
+	}
+
+	body := o.lookup(a.name)
+	if body == nil {
+		return firstAll
+	}
+	if len(a.args) > 0 {
+		var err error
+		body, err = body.substituteParams(a.args)
+		if err != nil {
+			return firstAll
+		}
+	}
+
+	o.firstVisiting[a.name] = true
+	f := o.first(body, lexical)
+	delete(o.firstVisiting, a.name)
+
+	if len(a.args) == 0 {
+		o.firsts[key] = f
+	}
+	return f
+}
+
+// DispatchAlt is an Alt that uses the first sets of its alternatives to skip
+// the ones that can't match the next rune. Alternatives that can are still
+// tried in order, so ordered choice is preserved.
+type DispatchAlt struct {
+	exprs []PExpr
+	table *dispatchTable
+}
+
+// dispatchTable holds a bitmask of candidate alternatives for each ASCII rune
+// and for the end of the input. Non-ASCII runes are checked against each
+// alternative's first set.
+type dispatchTable struct {
+	lexical bool
+	ascii   [utf8.RuneSelf]uint64
+	eof     uint64
+	always  uint64
+	classes []*CharClass
+}
+
+const maxDispatchAlts = 64
+
+func newDispatchAlt(exprs []PExpr, firsts []firstSet, lexical bool) *DispatchAlt {
+	t := &dispatchTable{lexical: lexical, classes: make([]*CharClass, len(exprs))}
+
+	for i, f := range firsts {
+		bit := uint64(1) << i
+		if f.nullable {
+			t.eof |= bit
+		}
+		if f.nullable || f.any {
+			t.always |= bit
+			continue
+		}
+		t.classes[i] = f.class
+		if f.class == nil {
+			continue
+		}
+		for r := rune(0); r < utf8.RuneSelf; r++ {
+			if f.class.contains(r) {
+				t.ascii[r] |= bit
+			}
+		}
+	}
+
+	for r := range t.ascii {
+		t.ascii[r] |= t.always
+	}
+
+	return &DispatchAlt{exprs, t}
+}
+
+// candidates returns the alternatives that might match the input at pos.
+func (t *dispatchTable) candidates(in *inputBuffer, pos int) uint64 {
+	r, size, err := in.peek(pos)
+	if err != nil {
+		// Let the alternatives report the error.
+		return ^uint64(0)
+	}
+	if size == 0 {
+		return t.eof
+	}
+	if r < utf8.RuneSelf {
+		return t.ascii[r]
+	}
+
+	mask := t.always
+	for i, c := range t.classes {
+		if c != nil && c.contains(r) {
+			mask |= 1 << i
+		}
+	}
+	return mask
+}
+
+func (a *DispatchAlt) Eval(m *MatchState) (bool, error) {
+	start := m.pos
+	mask := ^uint64(0)
+	if m.stack[len(m.stack)-1].lexical == a.table.lexical {
+		// Each alternative would skip spaces before matching, so do it
+		// once up front to find out which rune they'll see.
+		if !a.table.lexical {
+			if err := m.skipSpaces(); err != nil {
+				return false, err
+			}
+		}
+		mask = a.table.candidates(m.in, m.pos)
+	}
+
+	for i, expr := range a.exprs {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		res, err := m.try(expr)
+		if err != nil {
+			return false, err
+		}
+		if res {
+			return true, nil
+		}
+		if m.cutPast(start) {
+			return false, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (a *DispatchAlt) substituteParams(args []PExpr) (PExpr, error) {
+	newExprs := make([]PExpr, len(a.exprs))
+	for i, expr := range a.exprs {
+		newExpr, err := expr.substituteParams(args)
+		if err != nil {
+			return nil, err
+		}
+		newExprs[i] = newExpr
+	}
+
+	// Alternatives that contained parameters had conservative first sets,
+	// so the table is still valid.
+	return &DispatchAlt{newExprs, a.table}, nil
+}
@@ -54,7 +54,105 @@ func TestGrammarWithSuperGrammar(t *testing.T) {
 }
 
 func TestOhmGrammar(t *testing.T) {
-	res, err := OhmGrammar.MatchesRule("Grammars", `
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		res, err := g.MatchesRule("Grammars", ohmGrammarSource)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res {
+			t.Errorf("%s: expected=true actual=false", names[i])
+		}
+	}
+}
+
+func TestUnicodeCodePointEscape(t *testing.T) {
+	testMatchesRule(t, &OhmGrammar, "terminal", []test{
+		{`"\u{41}"`, true},
+		{`"\u{10FFFF}"`, true},
+		{`"\u{}"`, false},
+		{`"\u{1000000}"`, false},
+	})
+}
+
+func TestOhmGrammarWithRepetition(t *testing.T) {
+	source := `
+		G {
+			codePoint = "\\u{" hexDigit{1,6} "}"
+			pair = digit {2} | letter{1,} | "-"{3,3}
+		}
+	`
+	names, grammars := variants(&OhmGrammarWithRepetition)
+	for i, g := range grammars {
+		for _, input := range []string{ohmGrammarSource, source} {
+			res, err := g.MatchesRule("Grammars", input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if !res {
+				t.Errorf("%s: expected=true actual=false", names[i])
+			}
+		}
+
+		for _, input := range []string{`G { r = a{2,x} }`, `G { r = a{3,1} }`, `G { r = a{99999999999999999999} }`} {
+			res, err := g.MatchesRule("Grammars", input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res {
+				t.Errorf("%s: input=%q expected=false actual=true", names[i], input)
+			}
+		}
+	}
+
+	res, err := OhmGrammar.MatchesRule("Grammars", source)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res {
+		t.Errorf("expected OhmGrammar not to accept bounded repetition")
+	}
+}
+
+func BenchmarkOhmGrammar(b *testing.B) {
+	benchmarkOhmGrammar(b, &OhmGrammar)
+}
+
+func BenchmarkOhmGrammarCharClasses(b *testing.B) {
+	benchmarkOhmGrammar(b, OhmGrammar.optimize(false))
+}
+
+func BenchmarkOhmGrammarOptimized(b *testing.B) {
+	benchmarkOhmGrammar(b, OhmGrammar.Optimize())
+}
+
+func BenchmarkOhmGrammarClosures(b *testing.B) {
+	benchmarkOhmGrammar(b, OhmGrammar.WithBackend(BackendClosures))
+}
+
+func BenchmarkOhmGrammarClosuresOptimized(b *testing.B) {
+	benchmarkOhmGrammar(b, OhmGrammar.Optimize().WithBackend(BackendClosures))
+}
+
+func BenchmarkOhmGrammarMemoAuto(b *testing.B) {
+	benchmarkOhmGrammar(b, OhmGrammar.Optimize().WithMemoConfig(MemoConfig{Default: MemoAuto}))
+}
+
+func benchmarkOhmGrammar(b *testing.B, g *Grammar) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(ohmGrammarSource)))
+	for i := 0; i < b.N; i++ {
+		res, err := g.MatchesRule("Grammars", ohmGrammarSource)
+		if err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+		if !res {
+			b.Fatalf("expected=true actual=false")
+		}
+	}
+}
+
+const ohmGrammarSource = `
 		Ohm {
 
 			Grammars
@@ -179,11 +277,4 @@ func TestOhmGrammar(t *testing.T) {
 
 			punctuation = "<" | ">" | "," | "--"
 		}
-	`)
-	if err != nil {
-		t.Fatalf("unexpected error: %s", err)
-	}
-	if !res {
-		t.Errorf("expected=true actual=false")
-	}
-}
+	`
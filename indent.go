@@ -0,0 +1,230 @@
+package ohm
+
+import "math"
+
+// IndentationSensitive is a supergrammar for languages where indentation
+// delimits blocks, like Python. Besides the built-in rules, it has indent,
+// which opens a block where a line is indented more than the current one,
+// and dedent, which closes the current block where a line is indented
+// less. Both match the empty string. They only match at the first
+// character of a line that isn't a space or tab, which is where matching
+// is after skipping spaces in a syntactic rule, and dedent also matches at
+// the end of the input. A tab indents to the next multiple of 8 columns.
+//
+// A line that's neither an indent nor a dedent is in the current block, so
+// in these rules a Block is an indented run of Stmts, and lines indented
+// differently from their block don't match:
+//
+//	Block = indent Stmt+ dedent
+//	Stmt = ~indent ~dedent (ident ":" Block | ident)
+var IndentationSensitive Grammar = Grammar{
+	super: &BuiltInRules,
+	rules: map[string]PExpr{
+		"indent": &Indentation{},
+		"dedent": &Indentation{dedent: true},
+	},
+}
+
+// Indentation matches the empty string where a line's indentation opens a
+// block, or closes one if dedent is set. The blocks that are open are kept
+// on a stack while matching, which is restored when backtracking. See
+// IndentationSensitive.
+type Indentation struct {
+	dedent bool
+}
+
+func (i *Indentation) Eval(m *MatchState) (bool, error) {
+	indent, ok, err := m.memo.indents.next(m.in, m.pos, m.indent, i.dedent)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	m.indent = indent
+	return true, nil
+}
+
+func (i *Indentation) substituteParams(args []PExpr) (PExpr, error) {
+	return i, nil
+}
+
+// indentStacks interns indentation stacks, so a stack is an ID that's cheap
+// to save when backtracking and to compare when looking up memoized
+// results. Stack 0 is empty, and stack n is levels[n-1]. Memo entries
+// record the stacks before and after an application as a transition, which
+// fits in the entry's padding. Transition 0 is from the empty stack to
+// itself, and transition n is transitions[n-1].
+type indentStacks struct {
+	levels        []indentLevel
+	levelIDs      map[indentLevel]int32
+	transitions   []indentTransition
+	transitionIDs map[indentTransition]uint16
+}
+
+// indentLevel is a block indented by width columns, inside the blocks on
+// the stack up.
+type indentLevel struct {
+	up    int32
+	width int
+}
+
+type indentTransition struct {
+	from, to int32
+}
+
+// width returns the indentation of the innermost block on stack.
+func (s *indentStacks) width(stack int32) int {
+	if stack == 0 {
+		return 0
+	}
+	return s.levels[stack-1].width
+}
+
+// push returns stack with a block indented by width columns added.
+func (s *indentStacks) push(stack int32, width int) int32 {
+	l := indentLevel{up: stack, width: width}
+	if id, ok := s.levelIDs[l]; ok {
+		return id
+	}
+	if s.levelIDs == nil {
+		s.levelIDs = make(map[indentLevel]int32)
+	}
+
+	s.levels = append(s.levels, l)
+	id := int32(len(s.levels))
+	s.levelIDs[l] = id
+	return id
+}
+
+// pop returns stack without its innermost block.
+func (s *indentStacks) pop(stack int32) int32 {
+	return s.levels[stack-1].up
+}
+
+// next returns the stack after an indent, or a dedent if dedent is set, at
+// pos, or false if there isn't one there.
+func (s *indentStacks) next(in *inputBuffer, pos int, stack int32, dedent bool) (int32, bool, error) {
+	width, ok, err := lineIndent(in, pos)
+	if err != nil || !ok {
+		return stack, false, err
+	}
+
+	top := s.width(stack)
+	if !dedent {
+		if width <= top {
+			return stack, false, nil
+		}
+		return s.push(stack, width), true, nil
+	}
+
+	if stack == 0 || width >= top {
+		return stack, false, nil
+	}
+	return s.pop(stack), true, nil
+}
+
+// move returns the ID in other of stack.
+func (s *indentStacks) move(stack int32, other *indentStacks) int32 {
+	if stack == 0 {
+		return 0
+	}
+	l := s.levels[stack-1]
+	return other.push(s.move(l.up, other), l.width)
+}
+
+// transition returns the ID of the transition from one stack to another,
+// or false if there are too many to fit in a memo entry.
+func (s *indentStacks) transition(from, to int32) (uint16, bool) {
+	if from == 0 && to == 0 {
+		return 0, true
+	}
+
+	t := indentTransition{from, to}
+	if id, ok := s.transitionIDs[t]; ok {
+		return id, true
+	}
+	if len(s.transitions) == math.MaxUint16 {
+		return 0, false
+	}
+	if s.transitionIDs == nil {
+		s.transitionIDs = make(map[indentTransition]uint16)
+	}
+
+	s.transitions = append(s.transitions, t)
+	id := uint16(len(s.transitions))
+	s.transitionIDs[t] = id
+	return id, true
+}
+
+// from and to return the stacks before and after transition t.
+func (s *indentStacks) from(t uint16) int32 {
+	if t == 0 {
+		return 0
+	}
+	return s.transitions[t-1].from
+}
+
+func (s *indentStacks) to(t uint16) int32 {
+	if t == 0 {
+		return 0
+	}
+	return s.transitions[t-1].to
+}
+
+// lineIndent returns the width of the indentation before pos, if pos is the
+// first character on its line that isn't a space or tab. At the end of the
+// input, the width is 0. Blank lines have no indentation, and neither do
+// token streams.
+func lineIndent(in *inputBuffer, pos int) (int, bool, error) {
+	if in.tokens != nil {
+		return 0, false, nil
+	}
+
+	b, more, err := in.peekByte(pos)
+	if err != nil || !more {
+		return 0, err == nil, err
+	}
+	if b == '\n' || b == '\r' {
+		return 0, false, nil
+	}
+
+	start := pos
+	for start > 0 {
+		b, _, err := in.peekByte(start - 1)
+		if err != nil {
+			return 0, false, err
+		}
+		if b == '\n' || b == '\r' {
+			break
+		}
+		if b != ' ' && b != '\t' {
+			return 0, false, nil
+		}
+		start--
+	}
+
+	width := 0
+	for p := start; p < pos; p++ {
+		if b, _, _ := in.peekByte(p); b == '\t' {
+			width += 8 - width%8
+		} else {
+			width++
+		}
+	}
+	return width, true, nil
+}
+
+// indentationSensitive reports whether g's indent or dedent rule is an
+// Indentation, which means matching looks at the indentation of lines.
+func (g *Grammar) indentationSensitive() bool {
+	for _, name := range []string{"indent", "dedent"} {
+		for sg := g; sg != nil; sg = sg.super {
+			if body := sg.rules[name]; body != nil {
+				if _, ok := body.(*Indentation); ok {
+					return true
+				}
+				break
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package ohm
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func blocksGrammar() *Grammar {
+	return &Grammar{
+		super: &IndentationSensitive,
+		rules: map[string]PExpr{
+			"Program": &Plus{apply("Stmt")},
+			"Block":   seq(apply("indent"), &Plus{apply("Stmt")}, apply("dedent")),
+			"Stmt": seq(
+				&Not{apply("indent")},
+				&Not{apply("dedent")},
+				alt(seq(apply("ident"), lit(":"), apply("Block")), apply("ident")),
+			),
+			"ident": &Plus{apply("letter")},
+		},
+	}
+}
+
+func TestIndentation(t *testing.T) {
+	testMatchesRule(t, blocksGrammar(), "Program", []test{
+		{"a", true},
+		{"a:\n  b\n  c\nd", true},
+		{"a:\n  b:\n    c\nd", true},
+		{"a:\n  b:\n    c\n  d\ne", true},
+		{"a:\n  b:\n    c\n", true},
+		{"a:\n  b\n\n  \n  c", true},
+		{"a:\n\tb\n        c", true},
+		{"a:\n  b\n    c", false},
+		{"a:\n  b\n c", false},
+		{"a:\nb", false},
+		{"a:\n  b:\n  c", false},
+		{" a", false},
+		{"a b", true},
+		{"a:\n  b c\n  d", true},
+	})
+}
+
+// TestIndentationMemo checks that memoized results are only reused with the
+// indentation they were matched with.
+func TestIndentationMemo(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	never := blocksGrammar().WithMemoConfig(MemoConfig{Default: MemoNever})
+
+	names, grammars := variants(blocksGrammar())
+	for j := 0; j < 200; j++ {
+		var input []byte
+		for k := r.Intn(8); k >= 0; k-- {
+			input = append(input, []string{"a", ":", "\n", " ", "  ", "\t"}[r.Intn(6)]...)
+		}
+
+		expected, err := never.MatchesRule("Program", string(input))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for i, g := range grammars {
+			res, err := g.MatchesRule("Program", string(input))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res != expected {
+				t.Errorf("%s: input=%q expected=%v actual=%v", names[i], input, expected, res)
+			}
+		}
+	}
+}
+
+func TestIndentationMatcher(t *testing.T) {
+	names, grammars := variants(blocksGrammar())
+	for i, g := range grammars {
+		m := g.Matcher()
+		m.SetInput("a:\n  b\n  c")
+
+		tests := []struct {
+			start, end int
+			s          string
+			matches    bool
+		}{
+			{0, 0, "", true},
+			{7, 8, "", false},
+			{7, 7, " ", true},
+			{9, 10, "d:\n    e", true},
+			{3, 3, "  ", false},
+		}
+		for _, test := range tests {
+			if err := m.ReplaceInputRange(test.start, test.end, test.s); err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+
+			res, err := m.Match("Program")
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res.Succeeded() != test.matches {
+				t.Errorf("%s: input=%q expected=%v actual=%v", names[i], m.Input(), test.matches, res.Succeeded())
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package ohm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// readChunkSize is how much input is read from a reader at a time.
+const readChunkSize = 64 << 10
+
+// InvalidUTF8 controls how bytes that aren't valid UTF-8 are read.
+type InvalidUTF8 int
+
+const (
+	// InvalidUTF8Error stops the match with an error when an invalid byte
+	// is read.
+	InvalidUTF8Error InvalidUTF8 = iota
+
+	// InvalidUTF8Replace reads each invalid byte as U+FFFD, the Unicode
+	// replacement character.
+	InvalidUTF8Replace
+
+	// InvalidUTF8Bytes reads each invalid byte as a rune of its own, which
+	// is only matched by any and invalidByte.
+	InvalidUTF8Bytes
+)
+
+// invalidByteBase is added to an invalid byte to get the rune it's read as
+// with InvalidUTF8Bytes. It's past unicode.MaxRune, so the result can't be
+// mistaken for a valid rune.
+const invalidByteBase = unicode.MaxRune + 1
+
+// inputBuffer holds the input that's still needed during a match. Positions
+// are offsets from the start of the input. A string is held entirely. Input
+// from a reader is read in chunks as matching advances, and input before the
+// last released position is dropped.
+type inputBuffer struct {
+	s    string // the input starting at base
+	base int
+
+	// tokens is the input when matching a TokenStream.
+	tokens TokenStream
+
+	r     io.Reader
+	ctx   context.Context
+	buf   *strings.Builder
+	chunk []byte
+	eof   bool
+
+	// keep is the earliest position that might still be read.
+	keep int
+
+	// examined is the end of the input that was looked at, which is past
+	// the end of the input if the end was checked for. It's maintained per
+	// application for memo entries. See enter and exit.
+	examined int
+
+	invalid InvalidUTF8
+}
+
+func newStringInput(s string) *inputBuffer {
+	return &inputBuffer{s: s}
+}
+
+func newTokenInput(tokens TokenStream) *inputBuffer {
+	return &inputBuffer{tokens: tokens}
+}
+
+func newReaderInput(ctx context.Context, r io.Reader) *inputBuffer {
+	return &inputBuffer{
+		r:     r,
+		ctx:   ctx,
+		buf:   &strings.Builder{},
+		chunk: make([]byte, readChunkSize),
+	}
+}
+
+// peek decodes the rune at pos, returning a size of 0 at the end of the
+// input.
+func (in *inputBuffer) peek(pos int) (rune, int, error) {
+	if in.tokens != nil {
+		if _, ok := in.token(pos); !ok {
+			return 0, 0, nil
+		}
+		return tokenRune, 1, nil
+	}
+
+	i := pos - in.base
+	if i < 0 {
+		return 0, 0, fmt.Errorf("input at pos %d was already released", pos)
+	}
+	for in.r != nil && !utf8.FullRuneInString(in.s[i:]) {
+		more, err := in.fill()
+		if err != nil {
+			return 0, 0, err
+		}
+		if !more {
+			break
+		}
+		i = pos - in.base
+	}
+
+	if i >= len(in.s) {
+		if pos >= in.examined {
+			in.examined = pos + 1
+		}
+		return 0, 0, nil
+	}
+
+	r, size := utf8.DecodeRuneInString(in.s[i:])
+	if pos+size > in.examined {
+		in.examined = pos + size
+	}
+	if r == utf8.RuneError && size == 1 {
+		switch in.invalid {
+		case InvalidUTF8Replace:
+			return utf8.RuneError, 1, nil
+		case InvalidUTF8Bytes:
+			return invalidByteBase + rune(in.s[i]), 1, nil
+		}
+		return 0, 0, fmt.Errorf("invalid rune at pos %d", pos)
+	}
+	return r, size, nil
+}
+
+// peekByte returns the byte at pos, or false at the end of the input.
+func (in *inputBuffer) peekByte(pos int) (byte, bool, error) {
+	i := pos - in.base
+	if i < 0 {
+		return 0, false, fmt.Errorf("input at pos %d was already released", pos)
+	}
+	for in.r != nil && i >= len(in.s) {
+		more, err := in.fill()
+		if err != nil {
+			return 0, false, err
+		}
+		if !more {
+			break
+		}
+		i = pos - in.base
+	}
+
+	if pos >= in.examined {
+		in.examined = pos + 1
+	}
+	if i >= len(in.s) {
+		return 0, false, nil
+	}
+	return in.s[i], true, nil
+}
+
+// rest reads the rest of the input, and returns the input that's held
+// along with the position it starts at, which mustn't be after pos. All of
+// it counts as examined, but not the end.
+func (in *inputBuffer) rest(pos int) (string, int, error) {
+	if pos < in.base {
+		return "", 0, fmt.Errorf("input at pos %d was already released", pos)
+	}
+	for in.r != nil {
+		more, err := in.fill()
+		if err != nil {
+			return "", 0, err
+		}
+		if !more {
+			break
+		}
+	}
+
+	if end := in.base + len(in.s); end > in.examined {
+		in.examined = end
+	}
+	return in.s, in.base, nil
+}
+
+// token returns the token at pos, or false at the end of the tokens or if
+// the input isn't a TokenStream.
+func (in *inputBuffer) token(pos int) (Token, bool) {
+	if pos >= in.examined {
+		in.examined = pos + 1
+	}
+	if in.tokens == nil || pos >= in.tokens.Len() {
+		return Token{}, false
+	}
+	return in.tokens.Token(pos), true
+}
+
+// release records that nothing before pos will be read again.
+func (in *inputBuffer) release(pos int) {
+	if pos > in.keep {
+		in.keep = pos
+	}
+}
+
+// fill reads another chunk of input, reporting whether there was any.
+func (in *inputBuffer) fill() (bool, error) {
+	if in.r == nil || in.eof {
+		return false, nil
+	}
+
+	// Start a new buffer once at least half of the current one isn't needed
+	// anymore. Bytes in a buffer are never overwritten, so strings from
+	// earlier calls stay valid.
+	if drop := in.keep - in.base; drop > 0 && drop >= len(in.s)/2 {
+		buf := &strings.Builder{}
+		buf.Grow(len(in.s) - drop + readChunkSize)
+		buf.WriteString(in.s[drop:])
+		in.buf = buf
+		in.base = in.keep
+	}
+
+	for {
+		if err := in.ctx.Err(); err != nil {
+			return false, err
+		}
+
+		n, err := in.r.Read(in.chunk)
+		in.buf.Write(in.chunk[:n])
+		in.s = in.buf.String()
+
+		if err == io.EOF {
+			in.eof = true
+			return n > 0, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+}
+
+// all returns the whole input, or "" if it came from a reader and wasn't
+// kept.
+func (in *inputBuffer) all() string {
+	if in.r != nil {
+		return ""
+	}
+	return in.s
+}
+
+// pastEnd reports whether the end of the input was looked at.
+func (in *inputBuffer) pastEnd() bool {
+	if in.tokens != nil {
+		return in.examined > in.tokens.Len()
+	}
+	return in.examined > in.base+len(in.s)
+}
+
+// restart returns a buffer for matching the same input again from the
+// start. The input can't have come from a reader.
+func (in *inputBuffer) restart() *inputBuffer {
+	return &inputBuffer{s: in.s, tokens: in.tokens, invalid: in.invalid}
+}
@@ -0,0 +1,168 @@
+package ohm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+)
+
+func TestMatchReader(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start": seq(&Star{apply("letter")}, lit("→"), &Star{apply("digit")}),
+	})
+
+	tests := []test{
+		{"abc→123", true},
+		{"é→", true},
+		{"→", true},
+		{"abc→12a", false},
+		{"abc", false},
+		{"", false},
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		for _, test := range tests {
+			// Reading a byte at a time splits multibyte runes across reads.
+			r := iotest.OneByteReader(strings.NewReader(test.input))
+			res, err := g.MatchReader(context.Background(), r, "start")
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res.Succeeded() != test.matches {
+				t.Errorf("%s: input=\"%s\" expected=%v actual=%v", names[i], test.input, test.matches, res.Succeeded())
+			}
+		}
+	}
+}
+
+func TestMatchReaderOhmGrammar(t *testing.T) {
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		res, err := g.MatchReader(context.Background(), strings.NewReader(ohmGrammarSource), "Grammars")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected=true actual=false", names[i])
+		}
+		if res.Input() != "" {
+			t.Errorf("%s: expected the input not to be kept", names[i])
+		}
+	}
+}
+
+func TestMatchReaderReleasesInput(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"records": &Star{apply("record")},
+		"record":  seq(&Plus{apply("alnum")}, lit("\n")),
+	})
+	input := strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789\n", 5000)
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		in := newReaderInput(context.Background(), strings.NewReader(input))
+		res, err := g.match("records", in, MatchOptions{})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected=true actual=false", names[i])
+		}
+		if in.base == 0 || len(in.s) > 2*readChunkSize {
+			t.Errorf("%s: expected input to be released, holding %d bytes from %d", names[i], len(in.s), in.base)
+		}
+	}
+}
+
+func TestMatchReaderErrors(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start": &Star{&Any{}},
+	})
+
+	input := strings.Repeat("a", 2*readChunkSize) + "\xff"
+	_, err := g.MatchReader(context.Background(), strings.NewReader(input), "start")
+	if err == nil || !strings.Contains(err.Error(), "pos 131072") {
+		t.Errorf("expected an error at pos 131072, got %v", err)
+	}
+
+	errRead := errors.New("read failed")
+	r := io.MultiReader(strings.NewReader("aaa"), iotest.ErrReader(errRead))
+	_, err = g.MatchReader(context.Background(), r, "start")
+	if !errors.Is(err, errRead) {
+		t.Errorf("expected=%v actual=%v", errRead, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = g.MatchReader(ctx, strings.NewReader("aaa"), "start")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected=%v actual=%v", context.Canceled, err)
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"anything":    &Star{&Any{}},
+		"replacement": seq(&Star{apply("letter")}, &Char{utf8.RuneError}),
+		"latin1":      &Star{&Alt{[]PExpr{apply("letter"), apply("invalidByte")}}},
+		"softly":      &Alt{[]PExpr{lit("ab"), seq(lit("a"), &Any{}, lit("c"))}},
+	})
+
+	tests := []struct {
+		rule    string
+		input   string
+		policy  InvalidUTF8
+		matches bool
+		err     bool
+	}{
+		{"anything", "a\xffb", InvalidUTF8Error, false, true},
+		{"anything", "a\xffb", InvalidUTF8Replace, true, false},
+		{"anything", "a\xffb", InvalidUTF8Bytes, true, false},
+
+		// A valid U+FFFD is never an error.
+		{"replacement", "ab�", InvalidUTF8Error, true, false},
+		{"replacement", "ab\xff", InvalidUTF8Replace, true, false},
+		{"replacement", "ab\xff", InvalidUTF8Bytes, false, false},
+
+		{"latin1", "caf\xe9", InvalidUTF8Bytes, true, false},
+		{"latin1", "caf\xe9", InvalidUTF8Replace, false, false},
+		{"latin1", "café", InvalidUTF8Bytes, true, false},
+
+		{"softly", "a\xffc", InvalidUTF8Error, false, true},
+		{"softly", "a\xffc", InvalidUTF8Replace, true, false},
+		{"softly", "a\xffc", InvalidUTF8Bytes, true, false},
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		for _, test := range tests {
+			res, err := g.MatchWithOptions(test.rule, test.input, MatchOptions{InvalidUTF8: test.policy})
+			if test.err {
+				if err == nil {
+					t.Errorf("%s: rule=%s input=%q policy=%d: expected an error", names[i], test.rule, test.input, test.policy)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: rule=%s input=%q policy=%d: unexpected error: %s", names[i], test.rule, test.input, test.policy, err)
+			}
+			if res.Succeeded() != test.matches {
+				t.Errorf("%s: rule=%s input=%q policy=%d: expected=%v actual=%v", names[i], test.rule, test.input, test.policy, test.matches, res.Succeeded())
+			}
+		}
+
+		r := iotest.OneByteReader(strings.NewReader("caf\xe9"))
+		res, err := g.MatchReaderWithOptions(context.Background(), r, "latin1", MatchOptions{InvalidUTF8: InvalidUTF8Bytes})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected the reader to match", names[i])
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package ohm
+
+import (
+	"context"
+	"fmt"
+)
+
+// CanceledError is returned when a match's context is done. It wraps the
+// context's error.
+type CanceledError struct {
+	Pos int
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("match canceled at pos %d: %s", e.Pos, e.Err)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// StepLimitError is returned when a match takes more steps than
+// MatchOptions.MaxSteps allows. A step is a rule application, including one
+// whose result was memoized, or an iteration of a repetition.
+type StepLimitError struct {
+	Limit int
+	Pos   int
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("step limit of %d exceeded at pos %d", e.Limit, e.Pos)
+}
+
+// DepthLimitError is returned when rule applications nest more deeply than
+// MatchOptions.MaxDepth allows.
+type DepthLimitError struct {
+	Limit int
+	Pos   int
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("depth limit of %d exceeded at pos %d", e.Limit, e.Pos)
+}
+
+// MemoLimitError is returned when a memo table holds more entries than
+// MatchOptions.MaxMemoEntries allows.
+type MemoLimitError struct {
+	Limit int
+	Pos   int
+}
+
+func (e *MemoLimitError) Error() string {
+	return fmt.Sprintf("memo limit of %d entries exceeded at pos %d", e.Limit, e.Pos)
+}
+
+// cancelCheckInterval is how many steps are taken between checks of the
+// context, which are comparatively slow.
+const cancelCheckInterval = 1024
+
+// limits enforces the limits in MatchOptions during a match.
+type limits struct {
+	ctx      context.Context
+	maxSteps int
+	maxDepth int
+	maxMemo  int
+
+	steps int
+	depth int
+}
+
+// limits returns the limits for the match, or nil if there aren't any.
+func (opts *MatchOptions) limits() *limits {
+	if opts.lim != nil {
+		return opts.lim
+	}
+	if opts.Context == nil && opts.MaxSteps <= 0 && opts.MaxDepth <= 0 && opts.MaxMemoEntries <= 0 {
+		return nil
+	}
+	return &limits{
+		ctx:      opts.Context,
+		maxSteps: opts.MaxSteps,
+		maxDepth: opts.MaxDepth,
+		maxMemo:  opts.MaxMemoEntries,
+	}
+}
+
+// step is called for each step at pos: before looking up or evaluating a
+// rule application, and after each iteration of a repetition, which can
+// repeat forever without applying anything if its expression matches the
+// empty string.
+func (l *limits) step(pos int) error {
+	l.steps++
+	if l.maxSteps > 0 && l.steps > l.maxSteps {
+		return &StepLimitError{Limit: l.maxSteps, Pos: pos}
+	}
+	if l.ctx != nil && l.steps%cancelCheckInterval == 1 {
+		if err := l.ctx.Err(); err != nil {
+			return &CanceledError{Pos: pos, Err: err}
+		}
+	}
+	return nil
+}
+
+// enter is called before evaluating a rule application at pos, after step.
+// Every call must be followed by a call to exit, unless it returns an
+// error.
+func (l *limits) enter(pos int) error {
+	l.depth++
+	if l.maxDepth > 0 && l.depth > l.maxDepth {
+		return &DepthLimitError{Limit: l.maxDepth, Pos: pos}
+	}
+	return nil
+}
+
+// exit is called after evaluating a rule application.
+func (l *limits) exit() {
+	l.depth--
+}
+
+// memoized is called after memoizing a result at pos in t.
+func (l *limits) memoized(t *memoTable, pos int) error {
+	if l.maxMemo > 0 && t.live > l.maxMemo {
+		return &MemoLimitError{Limit: l.maxMemo, Pos: pos}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package ohm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxDepth(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"nested": &Alt{[]PExpr{seq(lit("("), apply("nested"), lit(")")), lit("x")}},
+	})
+	input := strings.Repeat("(", 1000) + "x" + strings.Repeat(")", 1000)
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		_, err := g.MatchWithOptions("nested", input, MatchOptions{MaxDepth: 100})
+		var depthErr *DepthLimitError
+		if !errors.As(err, &depthErr) || depthErr.Limit != 100 {
+			t.Errorf("%s: expected a depth limit error, got %v", names[i], err)
+		}
+
+		res, err := g.MatchWithOptions("nested", input, MatchOptions{MaxDepth: 2000})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected=true actual=false", names[i])
+		}
+	}
+}
+
+func TestMaxSteps(t *testing.T) {
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		_, err := g.MatchWithOptions("Grammars", ohmGrammarSource, MatchOptions{MaxSteps: 1000})
+		var stepErr *StepLimitError
+		if !errors.As(err, &stepErr) || stepErr.Limit != 1000 {
+			t.Errorf("%s: expected a step limit error, got %v", names[i], err)
+		}
+
+		res, err := g.MatchWithOptions("Grammars", ohmGrammarSource, MatchOptions{MaxSteps: 10000000})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected=true actual=false", names[i])
+		}
+	}
+}
+
+func TestMaxMemoEntries(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"records": &Star{apply("record")},
+		"record":  seq(&Plus{apply("alnum")}, lit("\n")),
+		"either":  &Alt{[]PExpr{seq(apply("records"), lit("!")), apply("records")}},
+	})
+	input := strings.Repeat("abc123\n", 1000)
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		// Memo entries are released after each record, so few are held at
+		// once.
+		res, err := g.MatchWithOptions("records", input, MatchOptions{MaxMemoEntries: 100})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected=true actual=false", names[i])
+		}
+
+		// The choice in either could backtrack to the start, so nothing is
+		// released.
+		_, err = g.MatchWithOptions("either", input, MatchOptions{MaxMemoEntries: 100})
+		var memoErr *MemoLimitError
+		if !errors.As(err, &memoErr) || memoErr.Limit != 100 {
+			t.Errorf("%s: expected a memo limit error, got %v", names[i], err)
+		}
+	}
+}
+
+func TestMatchContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		_, err := g.MatchWithOptions("Grammars", ohmGrammarSource, MatchOptions{Context: ctx})
+		var cancelErr *CanceledError
+		if !errors.As(err, &cancelErr) || !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected a cancellation error, got %v", names[i], err)
+		}
+
+		res, err := g.MatchWithOptions("Grammars", ohmGrammarSource, MatchOptions{Context: context.Background()})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected=true actual=false", names[i])
+		}
+	}
+}
+
+// TestLimitsEmptyRepetition checks that limits stop a repetition of an
+// expression that matches the empty string, which never ends and whose
+// applications are all memoized after the first.
+func TestLimitsEmptyRepetition(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"x": &Star{apply("y")},
+		"y": &Maybe{lit("a")},
+	})
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, err := g.MatchWithOptions("x", "b", MatchOptions{Context: ctx, MaxSteps: 1000})
+		cancel()
+		var stepErr *StepLimitError
+		if !errors.As(err, &stepErr) || stepErr.Limit != 1000 {
+			t.Errorf("%s: expected a step limit error, got %v", names[i], err)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, err = g.MatchWithOptions("x", "b", MatchOptions{Context: ctx})
+		cancel()
+		var cancelErr *CanceledError
+		if !errors.As(err, &cancelErr) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected a cancellation error, got %v", names[i], err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package ohm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Matcher matches a grammar against an input that changes over time, like a
+// document in an editor. It keeps its memo table between matches, and an
+// edit only invalidates the memoized results that looked at the edited part
+// of the input.
+type Matcher struct {
+	g      *Grammar
+	input  string
+	memo   memoTable
+	appIDs map[string]int32
+
+	// indented is set if g looks at the indentation of lines, which makes
+	// results after an edit on the same line depend on it.
+	indented bool
+}
+
+// Matcher returns a Matcher for g with an empty input.
+func (g *Grammar) Matcher() *Matcher {
+	m := &Matcher{g: g, indented: g.indentationSensitive()}
+	m.SetInput("")
+	return m
+}
+
+// Input returns the matcher's current input.
+func (m *Matcher) Input() string {
+	return m.input
+}
+
+// SetInput replaces the whole input, discarding all memoized results.
+func (m *Matcher) SetInput(input string) {
+	m.input = input
+	m.memo = memoTable{retain: true}
+	m.appIDs = make(map[string]int32)
+}
+
+// ReplaceInputRange replaces the input between the byte offsets start and
+// end with s.
+func (m *Matcher) ReplaceInputRange(start, end int, s string) error {
+	if start < 0 || end < start || end > len(m.input) {
+		return fmt.Errorf("invalid range [%d, %d) for input of length %d", start, end, len(m.input))
+	}
+
+	// Treating the rest of the line as replaced with itself drops the
+	// results there along with those in the edit.
+	edited := end
+	if m.indented {
+		if i := strings.IndexByte(m.input[end:], '\n'); i >= 0 {
+			edited += i
+		} else {
+			edited = len(m.input)
+		}
+	}
+
+	m.input = m.input[:start] + s + m.input[end:]
+	m.memo.edit(start, edited, len(s)-(end-start))
+	return nil
+}
+
+// Match matches the current input against the rule called name, followed by
+// the end of the input. Memo statistics in the result only count lookups
+// made by this match.
+func (m *Matcher) Match(name string) (*MatchResult, error) {
+	return m.match(name, MatchOptions{})
+}
+
+// MatchAt applies the rule called name at the byte offset pos, without
+// requiring it to be followed by the end of the input. The result's End is
+// where the rule's match ended. Results are memoized as with Match, so
+// applying many rules to the same input repeats little work.
+func (m *Matcher) MatchAt(name string, pos int) (*MatchResult, error) {
+	if pos < 0 || pos > len(m.input) {
+		return nil, fmt.Errorf("pos %d out of range for input of length %d", pos, len(m.input))
+	}
+	return m.match(name, MatchOptions{Prefix: true, start: pos})
+}
+
+func (m *Matcher) match(name string, opts MatchOptions) (*MatchResult, error) {
+	m.memo.lookups = 0
+	m.memo.hits = 0
+	opts.memo = &m.memo
+	opts.appIDs = m.appIDs
+	return m.g.match(name, newStringInput(m.input), opts)
+}
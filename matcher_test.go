@@ -0,0 +1,191 @@
+package ohm
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		m := g.Matcher()
+		m.SetInput(ohmGrammarSource)
+
+		r := rand.New(rand.NewSource(1))
+		for j := 0; j < 50; j++ {
+			// Make an edit, and then undo it half the time so the input
+			// keeps matching.
+			input := m.Input()
+			start := r.Intn(len(input) + 1)
+			end := start + r.Intn(min(4, len(input)-start)+1)
+			s := []string{"", " ", "x", "{", "=", "\n"}[r.Intn(6)]
+			if err := m.ReplaceInputRange(start, end, s); err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			testMatcherInput(t, names[i], g, m)
+
+			if r.Intn(2) == 0 {
+				if err := m.ReplaceInputRange(start, start+len(s), input[start:end]); err != nil {
+					t.Fatalf("%s: unexpected error: %s", names[i], err)
+				}
+				if m.Input() != input {
+					t.Fatalf("%s: expected the edit to be undone", names[i])
+				}
+				testMatcherInput(t, names[i], g, m)
+			}
+		}
+	}
+}
+
+// testMatcherInput checks that m gets the same result as matching its input
+// from scratch.
+func testMatcherInput(t *testing.T, name string, g *Grammar, m *Matcher) {
+	t.Helper()
+
+	expected, err := g.MatchesRule("Grammars", m.Input())
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %s", name, err)
+	}
+
+	res, err := m.Match("Grammars")
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %s", name, err)
+	}
+	if res.Succeeded() != expected {
+		t.Fatalf("%s: input=%q expected=%v actual=%v", name, m.Input(), expected, res.Succeeded())
+	}
+}
+
+func TestMatcherReusesMemo(t *testing.T) {
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		m := g.Matcher()
+		m.SetInput(ohmGrammarSource)
+
+		first, err := m.Match("Grammars")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+
+		// Rename the last rule.
+		pos := strings.LastIndex(ohmGrammarSource, "punctuation")
+		if err := m.ReplaceInputRange(pos, pos+len("punctuation"), "punct"); err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+
+		second, err := m.Match("Grammars")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !first.Succeeded() || !second.Succeeded() {
+			t.Fatalf("%s: expected both matches to succeed", names[i])
+		}
+
+		if second.MemoStats().Lookups*4 > first.MemoStats().Lookups {
+			t.Errorf("%s: expected far fewer lookups after a small edit, got %d then %d", names[i], first.MemoStats().Lookups, second.MemoStats().Lookups)
+		}
+	}
+}
+
+func TestMemoTableEdit(t *testing.T) {
+	memo := memoTable{retain: true}
+	memo.set(0, memoEntry{id: 1, res: true, end: 2, examined: 3})
+	memo.set(0, memoEntry{id: 2, res: true, end: 2, examined: 5})
+	memo.set(4, memoEntry{id: 1, res: false, end: 4, examined: 5})
+	memo.set(6, memoEntry{id: 1, res: true, end: 8, examined: 9})
+
+	// Replace [4, 6) with 3 bytes.
+	memo.edit(4, 6, 1)
+
+	tests := []struct {
+		id       int32
+		pos      int
+		ok       bool
+		end      int
+		examined int
+	}{
+		{1, 0, true, 2, 3},
+		{2, 0, false, 0, 0},
+		{1, 4, false, 0, 0},
+		{1, 6, false, 0, 0},
+		{1, 7, true, 9, 10},
+	}
+
+	for _, test := range tests {
+		e, ok := memo.get(test.id, test.pos, 0)
+		if ok != test.ok || e.end != test.end || e.examined != test.examined {
+			t.Errorf("id=%d pos=%d expected=(%v %d %d) actual=(%v %d %d)", test.id, test.pos, test.ok, test.end, test.examined, ok, e.end, e.examined)
+		}
+	}
+}
+
+func TestMatcherInvalidRange(t *testing.T) {
+	m := OhmGrammar.Matcher()
+	m.SetInput("abc")
+
+	for _, r := range [][2]int{{-1, 0}, {2, 1}, {0, 4}} {
+		if err := m.ReplaceInputRange(r[0], r[1], ""); err == nil {
+			t.Errorf("range=%v: expected an error", r)
+		}
+	}
+}
+
+func TestMatcherMatchAt(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"Words":  &Star{apply("word")},
+		"word":   &Plus{apply("letter")},
+		"number": &Plus{apply("digit")},
+	})
+
+	tests := []struct {
+		rule    string
+		pos     int
+		matches bool
+		end     int
+	}{
+		{"word", 0, true, 3},
+		{"number", 0, false, 0},
+		{"number", 4, true, 7},
+		{"Words", 7, true, 10},
+		{"Words", 0, true, 3},
+		{"word", 10, false, 10},
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		m := g.Matcher()
+		m.SetInput("abc 123 de")
+
+		for _, test := range tests {
+			res, err := m.MatchAt(test.rule, test.pos)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res.Succeeded() != test.matches || res.End() != test.end {
+				t.Errorf("%s: rule=%s pos=%d expected=(%v %d) actual=(%v %d)", names[i], test.rule, test.pos, test.matches, test.end, res.Succeeded(), res.End())
+			}
+		}
+
+		// Words already applied word at 0.
+		res, err := m.MatchAt("word", 0)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if res.MemoStats().Hits == 0 {
+			t.Errorf("%s: expected a memo hit", names[i])
+		}
+
+		res, err = m.Match("Words")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if res.Succeeded() {
+			t.Errorf("%s: expected Words not to match the whole input", names[i])
+		}
+
+		if _, err := m.MatchAt("word", 11); err == nil {
+			t.Errorf("%s: expected an error", names[i])
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package ohm
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// memoEntry is the memoized result of applying the rule with the given ID.
+// If cut is set, evaluating the rule passed a cut. indent is the
+// transition between the indentation stacks before and after. examined is
+// the end of the input that was looked at to get the result, which can be
+// past end.
+type memoEntry struct {
+	id       int32
+	res      bool
+	cut      bool
+	indent   uint16
+	end      int
+	examined int
+}
+
+// memoTable holds memoized rule applications in one column per input
+// position. Columns are short, so they're searched linearly by rule ID
+// rather than hashed. Columns before base have been released, unless the
+// table is retained across matches. live is the number of entries held.
+// Released columns are kept in free for reuse.
+type memoTable struct {
+	cols     [][]memoEntry
+	free     [][]memoEntry
+	base     int
+	retain   bool
+	live     int
+	entries  int
+	released int
+	lookups  int
+	hits     int
+
+	// indents interns the indentation stacks in entries.
+	indents indentStacks
+
+	// diagnosed holds the diagnostics of entries for applications that
+	// recovered from syntax errors. Few do, so they're kept out of entries.
+	diagnosed map[memoKey][]Diagnostic
+}
+
+// memoKey identifies the entry for the rule with the given ID at pos.
+type memoKey struct {
+	pos int
+	id  int32
+}
+
+// get returns the entry for the rule with the given ID applied at pos with
+// the indentation stack indent.
+func (t *memoTable) get(id int32, pos int, indent int32) (memoEntry, bool) {
+	t.lookups++
+	i := pos - t.base
+	if i < 0 || i >= len(t.cols) {
+		return memoEntry{}, false
+	}
+
+	for _, e := range t.cols[i] {
+		if e.id == id && t.indents.from(e.indent) == indent {
+			t.hits++
+			return e, true
+		}
+	}
+	return memoEntry{}, false
+}
+
+func (t *memoTable) set(pos int, e memoEntry) {
+	i := pos - t.base
+	if i < 0 {
+		return
+	}
+	if i >= len(t.cols) {
+		if i < cap(t.cols) {
+			t.cols = t.cols[:i+1]
+		} else {
+			cols := make([][]memoEntry, i+1, 2*i+1)
+			copy(cols, t.cols)
+			t.cols = cols
+		}
+	}
+
+	col := t.cols[i]
+	for j := range col {
+		if col[j].id == e.id {
+			col[j] = e
+			delete(t.diagnosed, memoKey{pos, e.id})
+			return
+		}
+	}
+
+	if col == nil && len(t.free) > 0 {
+		col = t.free[len(t.free)-1]
+		t.free = t.free[:len(t.free)-1]
+	}
+	t.cols[i] = append(col, e)
+	t.live++
+	t.entries++
+}
+
+// diagnose records the diagnostics of the application whose entry was just
+// set at pos, to be replayed when it's looked up.
+func (t *memoTable) diagnose(pos int, id int32, diagnostics []Diagnostic) {
+	if len(diagnostics) == 0 || pos < t.base {
+		return
+	}
+	if t.diagnosed == nil {
+		t.diagnosed = make(map[memoKey][]Diagnostic)
+	}
+	t.diagnosed[memoKey{pos, id}] = append([]Diagnostic(nil), diagnostics...)
+}
+
+// replayDiagnostics appends the diagnostics of the entry for id at pos to
+// diagnostics.
+func (t *memoTable) replayDiagnostics(diagnostics []Diagnostic, pos int, id int32) []Diagnostic {
+	if len(t.diagnosed) == 0 {
+		return diagnostics
+	}
+	return append(diagnostics, t.diagnosed[memoKey{pos, id}]...)
+}
+
+// indented records in e that its application went from the indentation
+// stack from to to, reporting whether it could be recorded.
+func (t *memoTable) indented(e *memoEntry, from, to int32) bool {
+	var ok bool
+	e.indent, ok = t.indents.transition(from, to)
+	return ok
+}
+
+// reset empties the table, keeping its columns' memory for reuse.
+func (t *memoTable) reset() {
+	cols := t.cols[:cap(t.cols)]
+	free := t.free
+	for i, col := range cols {
+		if col != nil {
+			free = append(free, col[:0])
+			cols[i] = nil
+		}
+	}
+	*t = memoTable{cols: cols[:0], free: free}
+}
+
+// release drops the entries before pos, which will never be looked up
+// again.
+func (t *memoTable) release(pos int) {
+	n := pos - t.base
+	if n <= 0 || t.retain {
+		return
+	}
+	if n > len(t.cols) {
+		n = len(t.cols)
+	}
+
+	for _, col := range t.cols[:n] {
+		t.released += len(col)
+		t.live -= len(col)
+		if col != nil {
+			t.free = append(t.free, col[:0])
+		}
+	}
+
+	// The rest are moved down rather than resliced, so that cols keeps its
+	// capacity.
+	k := copy(t.cols, t.cols[n:])
+	clear(t.cols[k:])
+	t.cols = t.cols[:k]
+	t.base = pos
+
+	for k := range t.diagnosed {
+		if k.pos < pos {
+			delete(t.diagnosed, k)
+		}
+	}
+}
+
+// edit updates the table after the input between start and end was replaced
+// with delta more bytes. Entries that examined the replaced input are
+// dropped, and entries after it are moved. Retained tables are never
+// released, so positions are indexes into cols.
+func (t *memoTable) edit(start, end, delta int) {
+	for p := 0; p < start && p < len(t.cols); p++ {
+		col := t.cols[p][:0]
+		for _, e := range t.cols[p] {
+			if e.examined <= start {
+				col = append(col, e)
+			}
+		}
+		t.live -= len(t.cols[p]) - len(col)
+		t.cols[p] = col
+	}
+	if start >= len(t.cols) {
+		t.editDiagnosed(start, end, delta)
+		return
+	}
+	for _, col := range t.cols[start:min(end, len(t.cols))] {
+		t.live -= len(col)
+	}
+
+	var tail [][]memoEntry
+	if end < len(t.cols) {
+		tail = t.cols[end:]
+	}
+	for _, col := range tail {
+		for i := range col {
+			col[i].end += delta
+			col[i].examined += delta
+		}
+	}
+
+	edited := end - start + delta
+	cols := make([][]memoEntry, start+edited, start+edited+len(tail))
+	copy(cols, t.cols[:start])
+	t.cols = append(cols, tail...)
+	t.editDiagnosed(start, end, delta)
+}
+
+// editDiagnosed moves the diagnostics of entries after an edit along with
+// them, and drops those of entries that edit dropped.
+func (t *memoTable) editDiagnosed(start, end, delta int) {
+	if len(t.diagnosed) == 0 {
+		return
+	}
+
+	diagnosed := make(map[memoKey][]Diagnostic)
+	for k, diagnostics := range t.diagnosed {
+		if k.pos >= end {
+			for i := range diagnostics {
+				diagnostics[i].Start += delta
+				diagnostics[i].End += delta
+			}
+			k.pos += delta
+		} else if k.pos >= start {
+			continue
+		}
+		if t.has(k) {
+			diagnosed[k] = diagnostics
+		}
+	}
+	t.diagnosed = diagnosed
+}
+
+// has reports whether the table holds the entry for k.
+func (t *memoTable) has(k memoKey) bool {
+	if k.pos < t.base || k.pos-t.base >= len(t.cols) {
+		return false
+	}
+	for _, e := range t.cols[k.pos-t.base] {
+		if e.id == k.id {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *memoTable) stats() MemoStats {
+	bytes := len(t.cols) * int(unsafe.Sizeof([]memoEntry{}))
+	for _, col := range t.cols {
+		bytes += cap(col) * int(unsafe.Sizeof(memoEntry{}))
+	}
+
+	return MemoStats{
+		Entries:  t.entries,
+		Released: t.released,
+		Lookups:  t.lookups,
+		Hits:     t.hits,
+		Bytes:    bytes,
+	}
+}
+
+// MemoStats describes the memo table used during a match.
+type MemoStats struct {
+	// Entries is the number of memoized rule applications. Released is the
+	// number of those that were dropped because nothing could backtrack to
+	// them anymore.
+	Entries  int
+	Released int
+
+	// Lookups is the number of times the table was consulted, and Hits is
+	// the number of those that found a memoized result.
+	Lookups int
+	Hits    int
+
+	// Bytes is an estimate of the memory used by the table's columns at the
+	// end of the match. Storage kept for reuse by later matches isn't
+	// counted.
+	Bytes int
+}
+
+// HitRate returns the fraction of lookups that found a memoized result.
+func (s MemoStats) HitRate() float64 {
+	if s.Lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Lookups)
+}
+
+// replay moves past a memoized result at the current position, including
+// any cut it passed. A failure that passed a cut has to stop choice points
+// that started at or before the current position.
+func (m *MatchState) replay(e memoEntry) {
+	start := m.pos
+	m.pos = e.end
+	m.indent = m.memo.indents.to(e.indent)
+	m.in.hit(e)
+	if e.res {
+		m.diagnostics = m.memo.replayDiagnostics(m.diagnostics, start, e.id)
+	}
+	if !e.cut {
+		return
+	}
+	if e.res {
+		m.cutAt(e.end)
+	} else {
+		m.cutAt(start + 1)
+	}
+}
+
+// hit is called on a memo hit, to account for the input the memoized
+// application examined.
+func (in *inputBuffer) hit(e memoEntry) {
+	if e.examined > in.examined {
+		in.examined = e.examined
+	}
+}
+
+// enter is called before evaluating an application at pos. It returns the
+// furthest position examined so far, which should be passed to exit along
+// with the entry for the application.
+func (in *inputBuffer) enter(pos int) int {
+	examined := in.examined
+	in.examined = pos
+	return examined
+}
+
+// exit records how far the application examined the input in e, and
+// restores the furthest position examined overall.
+func (in *inputBuffer) exit(examined int, e *memoEntry) {
+	e.examined = in.examined
+	if examined > in.examined {
+		in.examined = examined
+	}
+}
+
+// Rule names are interned into IDs shared by all grammars, so an Apply can
+// cache its ID no matter which grammar it's evaluated in.
+var ruleIDs = struct {
+	sync.Mutex
+	ids map[string]int32
+}{ids: make(map[string]int32)}
+
+func internRule(name string) int32 {
+	ruleIDs.Lock()
+	defer ruleIDs.Unlock()
+
+	id, ok := ruleIDs.ids[name]
+	if !ok {
+		id = int32(len(ruleIDs.ids)) + 1
+		ruleIDs.ids[name] = id
+	}
+	return id
+}
+
+// ruleID returns the memo ID for an application without arguments.
+func (a *Apply) ruleID() int32 {
+	id := atomic.LoadInt32(&a.id)
+	if id == 0 {
+		id = internRule(a.name)
+		atomic.StoreInt32(&a.id, id)
+	}
+	return id
+}
+
+// memoID returns the memo ID for app, whose arguments must not contain
+// parameters. Applications with arguments get negative IDs that are only
+// valid for the current match, or 0 if they shouldn't be memoized.
+func (m *MatchState) memoID(app *Apply) int32 {
+	if len(app.args) == 0 {
+		return app.ruleID()
+	}
+
+	key, ok := exprKey(app, maxArgsKeyLen)
+	if !ok {
+		return 0
+	}
+
+	id, ok := m.appIDs[key]
+	if !ok {
+		if m.appIDs == nil {
+			m.appIDs = make(map[string]int32)
+		}
+		id = -int32(len(m.appIDs)) - 1
+		m.appIDs[key] = id
+	}
+	return id
+}
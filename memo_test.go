@@ -0,0 +1,117 @@
+package ohm
+
+import "testing"
+
+func TestMemoTable(t *testing.T) {
+	var memo memoTable
+
+	if _, ok := memo.get(1, 5, 0); ok {
+		t.Fatalf("expected empty table")
+	}
+
+	memo.set(5, memoEntry{id: 1, res: true, end: 8})
+	memo.set(5, memoEntry{id: 2, res: false, end: 5})
+	memo.set(0, memoEntry{id: 1, res: false, end: 0})
+	memo.set(5, memoEntry{id: 1, res: true, end: 9})
+
+	tests := []struct {
+		id  int32
+		pos int
+		ok  bool
+		res bool
+		end int
+	}{
+		{1, 5, true, true, 9},
+		{2, 5, true, false, 5},
+		{1, 0, true, false, 0},
+		{2, 0, false, false, 0},
+		{1, 6, false, false, 0},
+	}
+
+	for _, test := range tests {
+		e, ok := memo.get(test.id, test.pos, 0)
+		if ok != test.ok || e.res != test.res || e.end != test.end {
+			t.Errorf("id=%d pos=%d expected=(%v %v %d) actual=(%v %v %d)", test.id, test.pos, test.ok, test.res, test.end, ok, e.res, e.end)
+		}
+	}
+
+	stats := memo.stats()
+	if stats.Entries != 3 {
+		t.Errorf("entries: expected=3 actual=%d", stats.Entries)
+	}
+	if stats.Lookups != 6 || stats.Hits != 3 {
+		t.Errorf("expected 3 hits out of 6 lookups, got %d out of %d", stats.Hits, stats.Lookups)
+	}
+	if stats.HitRate() != 0.5 {
+		t.Errorf("hit rate: expected=0.5 actual=%v", stats.HitRate())
+	}
+}
+
+// TestMemoTableReuse checks that a table keeps the storage of released
+// columns when it's reset for another match.
+func TestMemoTableReuse(t *testing.T) {
+	var memo memoTable
+	fill := func() {
+		memo.reset()
+		for pos := 0; pos < 1000; pos++ {
+			memo.set(pos, memoEntry{id: 1, res: true, end: pos + 1})
+			memo.set(pos, memoEntry{id: 2, res: false, end: pos})
+			if pos%100 == 99 {
+				memo.release(pos)
+			}
+		}
+		memo.release(1000)
+	}
+
+	fill()
+	if allocs := testing.AllocsPerRun(10, fill); allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+// TestMatchMemoAllocs checks that compiled backends reuse pooled memo tables
+// rather than allocating their entries again on every match. The interpreter
+// also allocates instances of parameterized rules, so it isn't checked.
+func TestMatchMemoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("pooled tables are dropped at random with the race detector")
+	}
+
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		if g.Backend() == BackendInterpreter {
+			continue
+		}
+
+		match := func() {
+			if _, err := g.Match("Grammars", ohmGrammarSource); err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+		}
+		match()
+		if allocs := testing.AllocsPerRun(100, match); allocs > 20 {
+			t.Errorf("%s: expected at most 20 allocations per match, got %v", names[i], allocs)
+		}
+	}
+}
+
+func TestMatchMemoStats(t *testing.T) {
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		res, err := g.Match("Grammars", ohmGrammarSource)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Fatalf("%s: expected=true actual=false", names[i])
+		}
+
+		stats := res.MemoStats()
+		if stats.Entries == 0 || stats.Bytes == 0 {
+			t.Errorf("%s: expected a non-empty memo table, got %+v", names[i], stats)
+		}
+		if stats.Hits == 0 || stats.Hits > stats.Lookups {
+			t.Errorf("%s: unexpected hits %d out of %d lookups", names[i], stats.Hits, stats.Lookups)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package ohm
+
+import (
+	"math"
+	"sync"
+)
+
+// MemoPolicy controls whether applications of a rule are memoized.
+type MemoPolicy int
+
+const (
+	// MemoDefault defers to the next level of configuration: match options
+	// defer to the grammar, and the grammar defers to MemoAlways.
+	MemoDefault MemoPolicy = iota
+
+	// MemoAlways memoizes every application of the rule.
+	MemoAlways
+
+	// MemoNever never memoizes the rule. This is a good fit for rules that
+	// are cheaper to re-run than to look up.
+	MemoNever
+
+	// MemoAuto memoizes the rule unless a static estimate of its cost says
+	// it's trivial, like a single character class.
+	MemoAuto
+)
+
+// MemoConfig assigns memoization policies to rules. Rules that aren't in
+// Rules use Default.
+type MemoConfig struct {
+	Default MemoPolicy
+	Rules   map[string]MemoPolicy
+}
+
+func (c *MemoConfig) policy(name string) MemoPolicy {
+	if c == nil {
+		return MemoDefault
+	}
+	if p := c.Rules[name]; p != MemoDefault {
+		return p
+	}
+	return c.Default
+}
+
+// WithMemoConfig returns a grammar with the same rules as g that memoizes
+// according to c. Policies in MatchOptions take precedence, but they're
+// decided again for every match, while the grammar's are decided once.
+//
+// Policies can only be set from Go. Grammars aren't built from Ohm source
+// in this package, so there's no annotation for them in OhmGrammar.
+func (g *Grammar) WithMemoConfig(c MemoConfig) *Grammar {
+	ng := g.derive(g.rules)
+	ng.memo = &c
+	ng.memoRules = &memoResolver{g: ng}
+	return ng
+}
+
+// autoMemoMaxCost is the largest cost of a rule that MemoAuto won't memoize.
+const autoMemoMaxCost = 8
+
+// costInfinite is the cost of expressions with unbounded work, like
+// repetitions and recursive rules.
+const costInfinite = -1
+
+// memoResolver decides which rules to memoize. A grammar's resolver is
+// shared by its matches, so rule costs are estimated under mu.
+type memoResolver struct {
+	g    *Grammar
+	opts *MemoConfig
+
+	mu       sync.Mutex
+	costs    map[string]int
+	visiting map[string]bool
+}
+
+// newMemoResolver returns the resolver for a match of g with the policies
+// in opts, or nil if every rule is memoized.
+func newMemoResolver(g *Grammar, opts *MemoConfig) *memoResolver {
+	if opts == nil {
+		return g.memoRules
+	}
+	return &memoResolver{g: g, opts: opts}
+}
+
+func (r *memoResolver) memoizes(name string) bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.opts.policy(name)
+	if p == MemoDefault {
+		p = r.g.memo.policy(name)
+	}
+
+	switch p {
+	case MemoNever:
+		return false
+	case MemoAuto:
+		cost := r.ruleCost(name)
+		return cost == costInfinite || cost > autoMemoMaxCost
+	default:
+		return true
+	}
+}
+
+func (r *memoResolver) lookup(name string) PExpr {
+	for g := r.g; g != nil; g = g.super {
+		if expr := g.rules[name]; expr != nil {
+			return expr
+		}
+	}
+	return nil
+}
+
+// ruleCost estimates how much work applying a rule takes, not counting
+// memoization. Syntactic rules skip spaces, which is a repetition, so they
+// always have infinite cost.
+func (r *memoResolver) ruleCost(name string) int {
+	if cost, ok := r.costs[name]; ok {
+		return cost
+	}
+	if r.costs == nil {
+		r.costs = make(map[string]int)
+		r.visiting = make(map[string]bool)
+	}
+	if r.visiting[name] {
+		return costInfinite
+	}
+
+	islex, err := (&Apply{name: name}).isLexical()
+	body := r.lookup(name)
+	if err != nil || !islex || body == nil {
+		r.costs[name] = costInfinite
+		return costInfinite
+	}
+
+	r.visiting[name] = true
+	cost := r.cost(body)
+	delete(r.visiting, name)
+
+	r.costs[name] = cost
+	return cost
+}
+
+func (r *memoResolver) cost(expr PExpr) int {
+	sum := func(exprs []PExpr) int {
+		total := 0
+		for _, e := range exprs {
+			total = addCost(total, r.cost(e))
+		}
+		return total
+	}
+
+	switch e := expr.(type) {
+	case *Cut:
+		return 0
+	case *Any, *Char, *Chars, *Range, *UnicodeCategories, *CharClass, *ByteRange, *TokenMatch, *Indentation:
+		return 1
+	case *Seq:
+		return sum(e.exprs)
+	case *Alt:
+		return sum(e.exprs)
+	case *DispatchAlt:
+		return sum(e.exprs)
+	case *Maybe:
+		return addCost(r.cost(e.expr), 1)
+	case *Repeat:
+		if e.max < 0 {
+			return costInfinite
+		}
+		return mulCost(addCost(r.cost(e.expr), 1), e.max)
+	case *Lookahead:
+		return addCost(r.cost(e.expr), 1)
+	case *Not:
+		return addCost(r.cost(e.expr), 1)
+	case *Apply:
+		if len(e.args) > 0 {
+			return costInfinite
+		}
+		return addCost(r.ruleCost(e.name), 1)
+	default:
+		return costInfinite
+	}
+}
+
+func addCost(a, b int) int {
+	if a == costInfinite || b == costInfinite {
+		return costInfinite
+	}
+	return a + b
+}
+
+// mulCost is the cost of doing something that costs a up to n times.
+func mulCost(a, n int) int {
+	if a == costInfinite || a > 0 && n > math.MaxInt32/a {
+		return costInfinite
+	}
+	return a * n
+}
+
+// MemoProfile holds per-rule memo statistics collected during one or more
+// matches. Collect profiles with every rule memoized, then turn them into a
+// MemoConfig with Config.
+type MemoProfile map[string]RuleMemoStats
+
+// RuleMemoStats counts memo lookups and hits for one rule.
+type RuleMemoStats struct {
+	Lookups int
+	Hits    int
+}
+
+func (p MemoProfile) record(name string, hit bool) {
+	s := p[name]
+	s.Lookups++
+	if hit {
+		s.Hits++
+	}
+	p[name] = s
+}
+
+// Merge adds the counts in other to p.
+func (p MemoProfile) Merge(other MemoProfile) {
+	for name, s := range other {
+		t := p[name]
+		t.Lookups += s.Lookups
+		t.Hits += s.Hits
+		p[name] = t
+	}
+}
+
+// Config returns a MemoConfig that never memoizes rules whose hit rate was
+// below minHitRate, and always memoizes the rest.
+func (p MemoProfile) Config(minHitRate float64) MemoConfig {
+	c := MemoConfig{Rules: make(map[string]MemoPolicy)}
+	for name, s := range p {
+		if s.Lookups > 0 && float64(s.Hits)/float64(s.Lookups) < minHitRate {
+			c.Rules[name] = MemoNever
+		} else {
+			c.Rules[name] = MemoAlways
+		}
+	}
+	return c
+}
@@ -0,0 +1,136 @@
+package ohm
+
+import "testing"
+
+func TestMemoPolicies(t *testing.T) {
+	configs := []MemoConfig{
+		{Default: MemoNever},
+		{Default: MemoAuto},
+		{Rules: map[string]MemoPolicy{"Rule": MemoNever, "ident": MemoAuto}},
+	}
+
+	names, grammars := variants(&OhmGrammar)
+	for _, c := range configs {
+		for i, g := range grammars {
+			for _, g := range []*Grammar{g.WithMemoConfig(c), g} {
+				opts := MatchOptions{}
+				if g.memo == nil {
+					opts.Memo = &c
+				}
+
+				res, err := g.MatchWithOptions("Grammars", ohmGrammarSource, opts)
+				if err != nil {
+					t.Fatalf("%s: unexpected error: %s", names[i], err)
+				}
+				if !res.Succeeded() {
+					t.Errorf("%s %+v: expected=true actual=false", names[i], c)
+				}
+				if c.Default == MemoNever && res.MemoStats().Lookups != 0 {
+					t.Errorf("%s: expected no memo lookups, got %d", names[i], res.MemoStats().Lookups)
+				}
+			}
+		}
+	}
+}
+
+func TestMemoOptionsOverrideGrammar(t *testing.T) {
+	g := OhmGrammar.WithMemoConfig(MemoConfig{Default: MemoNever})
+
+	res, err := g.MatchWithOptions("Grammars", ohmGrammarSource, MatchOptions{
+		Memo: &MemoConfig{Rules: map[string]MemoPolicy{"Rule": MemoAlways}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.MemoStats().Entries == 0 {
+		t.Errorf("expected Rule to be memoized")
+	}
+}
+
+// TestMemoAutoDecidedOnce checks that a grammar's policies are decided by
+// one resolver that's shared by its matches, so costs are estimated once.
+func TestMemoAutoDecidedOnce(t *testing.T) {
+	names, grammars := variants(OhmGrammar.WithMemoConfig(MemoConfig{Default: MemoAuto}))
+	for i, g := range grammars {
+		for j := 0; j < 2; j++ {
+			res, err := g.Match("Grammars", ohmGrammarSource)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if !res.Succeeded() {
+				t.Errorf("%s: expected=true actual=false", names[i])
+			}
+		}
+
+		if newMemoResolver(g, nil) != g.memoRules {
+			t.Errorf("%s: expected matches to share the grammar's resolver", names[i])
+		}
+		if len(g.memoRules.costs) == 0 {
+			t.Errorf("%s: expected the grammar's resolver to hold rule costs", names[i])
+		}
+	}
+}
+
+func TestMemoAutoCost(t *testing.T) {
+	r := newMemoResolver(&OhmGrammar, &MemoConfig{Default: MemoAuto})
+
+	tests := []struct {
+		rule     string
+		memoizes bool
+	}{
+		{"digit", false},
+		{"hexDigit", false},
+		{"space", false},
+		{"ident", true},
+		{"Grammar", true},
+	}
+
+	for _, test := range tests {
+		if m := r.memoizes(test.rule); m != test.memoizes {
+			t.Errorf("rule=%s expected=%v actual=%v", test.rule, test.memoizes, m)
+		}
+	}
+}
+
+func TestMemoProfile(t *testing.T) {
+	names, grammars := variants(&OhmGrammar)
+	for i, g := range grammars {
+		res, err := g.MatchWithOptions("Grammars", ohmGrammarSource, MatchOptions{ProfileMemo: true})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+
+		profile := res.MemoProfile()
+		if profile["Rule"].Lookups == 0 {
+			t.Errorf("%s: expected lookups of Rule, got %+v", names[i], profile["Rule"])
+		}
+
+		total := make(MemoProfile)
+		total.Merge(profile)
+		total.Merge(profile)
+		if total["Rule"].Lookups != 2*profile["Rule"].Lookups {
+			t.Errorf("%s: merge: expected=%d actual=%d", names[i], 2*profile["Rule"].Lookups, total["Rule"].Lookups)
+		}
+
+		c := profile.Config(1)
+		if len(c.Rules) != len(profile) {
+			t.Errorf("%s: expected a policy for every profiled rule", names[i])
+		}
+
+		res, err = g.WithMemoConfig(c).Match("Grammars", ohmGrammarSource)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected=true actual=false", names[i])
+		}
+	}
+
+	res, err := OhmGrammar.Match("Grammars", ohmGrammarSource)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.MemoProfile() != nil {
+		t.Errorf("expected no profile unless requested")
+	}
+}
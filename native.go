@@ -0,0 +1,71 @@
+package ohm
+
+import "fmt"
+
+// NativeFunc matches the input at the byte offset pos, returning where the
+// match ended, or false if it failed. It can look at any of the input from
+// pos on, but its result mustn't depend on the input before pos, since a
+// Matcher keeps results after an edit. It's called from every goroutine the
+// grammar is matched from.
+type NativeFunc func(input string, pos int) (end int, ok bool)
+
+// WithNativeRule returns a grammar like g with a rule called name that's
+// matched by calling fn, for things a PEG can't express well, like checking
+// a word against a dictionary loaded at runtime. Other rules apply it by
+// name like any other rule, and if name is capitalized, spaces are skipped
+// before calling fn. Native rules never match a TokenStream, and with input
+// from a reader, the rest of the input is read before fn is called, and
+// input is what's still held of it.
+func (g *Grammar) WithNativeRule(name string, fn NativeFunc) (*Grammar, error) {
+	if _, err := (&Apply{name: name}).isLexical(); err != nil {
+		return nil, err
+	}
+
+	rules := make(map[string]PExpr, len(g.rules)+1)
+	for rule, body := range g.rules {
+		rules[rule] = body
+	}
+	rules[name] = &Native{name: name, fn: fn}
+
+	return g.derive(rules), nil
+}
+
+// Native matches the input with a Go function. See WithNativeRule.
+type Native struct {
+	name string
+	fn   NativeFunc
+}
+
+func (n *Native) Eval(m *MatchState) (bool, error) {
+	end, ok, err := n.match(m.in, m.pos)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	m.pos = end
+	return true, nil
+}
+
+func (n *Native) match(in *inputBuffer, pos int) (int, bool, error) {
+	if in.tokens != nil {
+		return pos, false, nil
+	}
+
+	input, base, err := in.rest(pos)
+	if err != nil {
+		return pos, false, err
+	}
+
+	end, ok := n.fn(input, pos-base)
+	if !ok {
+		return pos, false, nil
+	}
+	if end < pos-base || end > len(input) {
+		return pos, false, fmt.Errorf("native rule \"%s\" ended at %d, outside [%d, %d]", n.name, end, pos-base, len(input))
+	}
+	return base + end, true, nil
+}
+
+func (n *Native) substituteParams(args []PExpr) (PExpr, error) {
+	return n, nil
+}
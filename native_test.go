@@ -0,0 +1,111 @@
+package ohm
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// dictionary matches a run of lowercase letters that's one of words.
+func dictionary(words ...string) NativeFunc {
+	return func(input string, pos int) (int, bool) {
+		end := pos
+		for end < len(input) && input[end] >= 'a' && input[end] <= 'z' {
+			end++
+		}
+		for _, w := range words {
+			if input[pos:end] == w {
+				return end, true
+			}
+		}
+		return pos, false
+	}
+}
+
+// checksum matches digits followed by "-" and their sum mod 10.
+func checksum(input string, pos int) (int, bool) {
+	sum, end := 0, pos
+	for end < len(input) && input[end] >= '0' && input[end] <= '9' {
+		sum += int(input[end] - '0')
+		end++
+	}
+	if end == pos || end+2 > len(input) || input[end] != '-' || int(input[end+1]-'0') != sum%10 {
+		return pos, false
+	}
+	return end + 2, true
+}
+
+func nativeGrammar(t *testing.T) *Grammar {
+	t.Helper()
+
+	g := grammar(map[string]PExpr{
+		"Sentence": seq(&Plus{apply("keyword")}, &Maybe{apply("Code")}),
+		"Code":     seq(lit("#"), apply("checked")),
+	})
+	g, err := g.WithNativeRule("keyword", dictionary("go", "ohm", "peg"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	g, err = g.WithNativeRule("checked", checksum)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return g
+}
+
+func TestNativeRule(t *testing.T) {
+	testMatchesRule(t, nativeGrammar(t), "Sentence", []test{
+		{"go", true},
+		{"ohm  peg go", true},
+		{"ohm pegs", false},
+		{"gopeg", false},
+		{"", false},
+		{"peg # 123-6", true},
+		{"peg # 123-5", false},
+		{"peg # 123 -6", false},
+		{"peg # -0", false},
+	})
+}
+
+func TestNativeRuleReader(t *testing.T) {
+	names, grammars := variants(nativeGrammar(t))
+	for i, g := range grammars {
+		input := strings.Repeat("go ohm ", 20000) + "# 99-8"
+		res, err := g.MatchReader(context.Background(), strings.NewReader(input), "Sentence")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected a match", names[i])
+		}
+	}
+}
+
+func TestNativeRuleErrors(t *testing.T) {
+	if _, err := OhmGrammar.WithNativeRule("", checksum); err == nil || err.Error() != `invalid rule name ""` {
+		t.Errorf("expected an invalid rule name error, got %v", err)
+	}
+
+	g, err := grammar(map[string]PExpr{}).WithNativeRule("back", func(input string, pos int) (int, bool) {
+		return pos - 1, true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		_, err := g.Match("back", "x")
+		if err == nil || err.Error() != `native rule "back" ended at -1, outside [0, 1]` {
+			t.Errorf("%s: expected an invalid end error, got %v", names[i], err)
+		}
+
+		res, err := g.MatchTokens("back", Tokens{{Kind: "x"}})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if res.Succeeded() {
+			t.Errorf("%s: expected native rules not to match tokens", names[i])
+		}
+	}
+}
@@ -0,0 +1,5 @@
+//go:build !race
+
+package ohm
+
+const raceEnabled = false
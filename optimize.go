@@ -0,0 +1,266 @@
+package ohm
+
+// Optimize returns a grammar that matches exactly the same inputs as g, with
+// its rules rewritten into faster expressions. Runs of single-rune
+// alternatives (Char, Chars, Range, Unicode categories, and applications of
+// lexical rules made only of those) are merged into a CharClass, and the
+// remaining alternations become DispatchAlts.
+//
+// Rules are resolved against g, so the returned grammar contains every rule
+// visible from g, including inherited ones. g is not modified. Expressions
+// in a syntactic context are left alone unless spaces is a repetition, since
+// the rewrites rely on skipping spaces twice being the same as skipping once.
+func (g *Grammar) Optimize() *Grammar {
+	return g.optimize(true)
+}
+
+func (g *Grammar) optimize(dispatch bool) *Grammar {
+	o := &optimizer{
+		g:             g,
+		dispatch:      dispatch,
+		classes:       make(map[string]*CharClass),
+		visiting:      make(map[string]bool),
+		firsts:        make(map[firstKey]firstSet),
+		firstVisiting: make(map[string]bool),
+	}
+
+	// Skipping spaces twice in a row does nothing the second time if spaces
+	// is a repetition, which is what makes it safe to rewrite expressions in
+	// a syntactic context.
+	_, o.syntactic = o.lookup("spaces").(*Star)
+
+	rules := make(map[string]PExpr)
+	for sg := g; sg != nil; sg = sg.super {
+		for name, body := range sg.rules {
+			if _, ok := rules[name]; ok {
+				continue
+			}
+			islex, _ := (&Apply{name: name}).isLexical()
+			rules[name] = o.rewrite(body, islex)
+		}
+	}
+
+	return g.derive(rules)
+}
+
+type optimizer struct {
+	g         *Grammar
+	dispatch  bool
+	syntactic bool
+
+	classes  map[string]*CharClass
+	visiting map[string]bool
+
+	firsts        map[firstKey]firstSet
+	firstVisiting map[string]bool
+}
+
+func (o *optimizer) lookup(name string) PExpr {
+	for g := o.g; g != nil; g = g.super {
+		if expr := g.rules[name]; expr != nil {
+			return expr
+		}
+	}
+	return nil
+}
+
+// ruleClass returns the CharClass equivalent to applying the rule called name,
+// or nil if there isn't one. Only lexical rules qualify: applying a syntactic
+// rule from a lexical context skips spaces, which a CharClass wouldn't.
+func (o *optimizer) ruleClass(name string) *CharClass {
+	if c, ok := o.classes[name]; ok {
+		return c
+	}
+	if o.visiting[name] {
+		return nil
+	}
+
+	islex, err := (&Apply{name: name}).isLexical()
+	if err != nil || !islex {
+		return nil
+	}
+
+	body := o.lookup(name)
+	if body == nil {
+		return nil
+	}
+
+	o.visiting[name] = true
+	c := o.class(body)
+	delete(o.visiting, name)
+
+	o.classes[name] = c
+	return c
+}
+
+// class returns a CharClass that matches the same runes as expr, or nil if
+// expr can't be expressed as one.
+func (o *optimizer) class(expr PExpr) *CharClass {
+	var b classBuilder
+
+	switch e := expr.(type) {
+	case *CharClass, *Char, *Chars, *Range, *UnicodeCategories:
+		return primitiveClass(e)
+	case *Apply:
+		if len(e.args) > 0 {
+			return nil
+		}
+		return o.ruleClass(e.name)
+	case *Alt:
+		if len(e.exprs) == 0 {
+			return nil
+		}
+		for _, expr := range e.exprs {
+			c := o.class(expr)
+			if c == nil {
+				return nil
+			}
+			b.addClass(c)
+		}
+	case *Seq:
+		return o.seqClass(e)
+	default:
+		return nil
+	}
+
+	return b.class()
+}
+
+// seqClass handles sequences of negative lookaheads followed by a single
+// rune, like `~"\\" ~"\"" "\u{0}".."\u{10FFFF}"`, which match the last
+// class minus the excluded ones.
+func (o *optimizer) seqClass(s *Seq) *CharClass {
+	if len(s.exprs) == 0 {
+		return nil
+	}
+
+	last := o.class(s.exprs[len(s.exprs)-1])
+	if last == nil {
+		return nil
+	}
+	if len(s.exprs) == 1 {
+		return last
+	}
+
+	var b classBuilder
+	b.addClass(last)
+	for _, expr := range s.exprs[:len(s.exprs)-1] {
+		not, ok := expr.(*Not)
+		if !ok {
+			return nil
+		}
+		c := o.class(not.expr)
+		if c == nil {
+			return nil
+		}
+		b.subtract(c)
+	}
+	return b.class()
+}
+
+// rewrite returns an optimized copy of expr, which is evaluated in a lexical
+// or syntactic context.
+func (o *optimizer) rewrite(expr PExpr, lexical bool) PExpr {
+	if !lexical && !o.syntactic {
+		return expr
+	}
+
+	switch e := expr.(type) {
+	case *Chars, *Seq:
+		if c := o.class(e); c != nil {
+			return c
+		}
+		if s, ok := e.(*Seq); ok {
+			return &Seq{o.rewriteAll(s.exprs, lexical)}
+		}
+		return e
+	case *Alt:
+		return o.rewriteAlt(e, lexical)
+	case *Maybe:
+		return &Maybe{o.rewrite(e.expr, lexical)}
+	case *Star:
+		return &Star{o.rewrite(e.expr, lexical)}
+	case *Plus:
+		return &Plus{o.rewrite(e.expr, lexical)}
+	case *Repeat:
+		return &Repeat{expr: o.rewrite(e.expr, lexical), min: e.min, max: e.max}
+	case *Lookahead:
+		return &Lookahead{o.rewrite(e.expr, lexical)}
+	case *Not:
+		return &Not{o.rewrite(e.expr, lexical)}
+	case *Recover:
+		return &Recover{name: e.name, expr: o.rewrite(e.expr, lexical), sync: e.sync, bytes: e.bytes}
+	case *Apply:
+		if len(e.args) == 0 {
+			return e
+		}
+		// Arguments are evaluated in the context of the rule they're passed to.
+		islex, err := e.isLexical()
+		if err != nil {
+			return e
+		}
+		return &Apply{name: e.name, args: o.rewriteAll(e.args, islex)}
+	default:
+		return e
+	}
+}
+
+func (o *optimizer) rewriteAll(exprs []PExpr, lexical bool) []PExpr {
+	newExprs := make([]PExpr, len(exprs))
+	for i, expr := range exprs {
+		newExprs[i] = o.rewrite(expr, lexical)
+	}
+	return newExprs
+}
+
+// rewriteAlt merges consecutive alternatives that each match a single rune.
+// Only adjacent alternatives can be merged, otherwise a longer alternative
+// in between could lose its priority.
+func (o *optimizer) rewriteAlt(a *Alt, lexical bool) PExpr {
+	var exprs, orig []PExpr
+	var run []*CharClass
+
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+
+		var c *CharClass
+		if len(run) == 1 {
+			c = run[0]
+		} else {
+			var b classBuilder
+			for _, c := range run {
+				b.addClass(c)
+			}
+			c = b.class()
+		}
+		exprs = append(exprs, c)
+		orig = append(orig, c)
+		run = nil
+	}
+
+	for _, expr := range a.exprs {
+		if c := o.class(expr); c != nil {
+			run = append(run, c)
+			continue
+		}
+		flush()
+		exprs = append(exprs, o.rewrite(expr, lexical))
+		orig = append(orig, expr)
+	}
+	flush()
+
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	if !o.dispatch || len(exprs) > maxDispatchAlts {
+		return &Alt{exprs}
+	}
+
+	firsts := make([]firstSet, len(orig))
+	for i, expr := range orig {
+		firsts[i] = o.first(expr, lexical)
+	}
+	return newDispatchAlt(exprs, firsts, lexical)
+}
@@ -0,0 +1,182 @@
+package ohm
+
+import "testing"
+
+func TestCharClass(t *testing.T) {
+	var b classBuilder
+	b.addRange('a', 'c')
+	b.addRange('x', 'x')
+	b.addRange('λ', 'μ')
+	b.addRange('β', 'δ')
+	c := b.class()
+
+	tests := []struct {
+		r        rune
+		contains bool
+	}{
+		{'a', true},
+		{'c', true},
+		{'d', false},
+		{'x', true},
+		{'α', false},
+		{'β', true},
+		{'γ', true},
+		{'δ', true},
+		{'ε', false},
+		{'λ', true},
+		{'μ', true},
+		{'ν', false},
+	}
+
+	for _, test := range tests {
+		if c.contains(test.r) != test.contains {
+			t.Errorf("rune=%q expected=%v actual=%v", test.r, test.contains, !test.contains)
+		}
+	}
+}
+
+func TestCharClassSubtract(t *testing.T) {
+	var b classBuilder
+	b.addRange(0, 0x10FFFF)
+
+	var ex classBuilder
+	ex.addRange('"', '"')
+	ex.addRange('é', 'é')
+	b.subtract(ex.class())
+	c := b.class()
+
+	for _, r := range []rune{'"', 'é'} {
+		if c.contains(r) {
+			t.Errorf("expected %q to be excluded", r)
+		}
+	}
+	for _, r := range []rune{0, 'a', 'è', 'ê', 0x10FFFF} {
+		if !c.contains(r) {
+			t.Errorf("expected %q to be included", r)
+		}
+	}
+}
+
+func TestOptimizeMergesClasses(t *testing.T) {
+	g := OhmGrammar.Optimize()
+
+	for _, name := range []string{"hexDigit", "alnum", "nameRest", "space"} {
+		if _, ok := g.rules[name].(*CharClass); !ok {
+			t.Errorf("rule %s: expected *CharClass, got %T", name, g.rules[name])
+		}
+	}
+
+	exprs := alternatives(g.rules["terminalChar"])
+	if len(exprs) != 2 {
+		t.Fatalf("terminalChar: expected 2 alternatives, got %#v", g.rules["terminalChar"])
+	}
+	if _, ok := exprs[1].(*CharClass); !ok {
+		t.Errorf("terminalChar: expected second alternative to be *CharClass, got %T", exprs[1])
+	}
+}
+
+func TestOptimizeKeepsAltOrder(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start": seq(alt(lit("a"), lit("bc"), lit("b")), &Star{&Any{}}),
+	})
+	optimized := g.Optimize()
+
+	if exprs := alternatives(optimized.rules["start"].(*Seq).exprs[0]); len(exprs) != 3 {
+		t.Errorf("expected non-adjacent alternatives to stay separate, got %#v", optimized.rules["start"])
+	}
+
+	testMatchesRule(t, g, "start", []test{
+		{"a", true},
+		{"bc", true},
+		{"b", true},
+		{"c", false},
+	})
+}
+
+func TestDispatchAlt(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start": alt(lit("ab"), lit("a"), seq(lit("b"), &Star{&Any{}}), maybe(lit("c"))),
+		"Start": alt(lit("ab"), lit("a"), seq(lit("b"), &Star{&Any{}}), maybe(lit("c"))),
+		"greek": alt(seq(&Range{'α', 'ω'}, lit("!")), lit("a"), &Range{'α', 'ω'}),
+	})
+	optimized := g.Optimize()
+
+	if _, ok := optimized.rules["start"].(*DispatchAlt); !ok {
+		t.Fatalf("expected *DispatchAlt, got %T", optimized.rules["start"])
+	}
+
+	testMatchesRule(t, g, "start", []test{
+		{"ab", true},
+		{"a", true},
+		{"b", true},
+		{"bcd", true},
+		{"c", true},
+		{"", true},
+		{"d", false},
+		{" a", false},
+	})
+	testMatchesRule(t, g, "Start", []test{
+		{" ab", true},
+		{"  a ", true},
+		{" b cd", true},
+		{" c", true},
+		{" ", true},
+		{" d", false},
+	})
+	testMatchesRule(t, g, "greek", []test{
+		{"λ!", true},
+		{"λ", true},
+		{"a", true},
+		{"€", false},
+		{"", false},
+	})
+}
+
+func TestDispatchAltCandidates(t *testing.T) {
+	g := OhmGrammar.Optimize()
+
+	base, ok := g.rules["Base"].(*DispatchAlt)
+	if !ok {
+		t.Fatalf("Base: expected *DispatchAlt, got %T", g.rules["Base"])
+	}
+
+	tests := []struct {
+		input string
+		mask  uint64
+	}{
+		{"foo", 0b0001}, // application
+		{`"a"`, 0b0110}, // range or terminal
+		{"(", 0b1000},   // paren
+		{"*", 0b0000},   // nothing
+		{"", 0b0000},    // end of input
+		{"λ", 0b0001},   // application
+		{"€", 0b0000},   // nothing
+	}
+
+	for _, test := range tests {
+		if mask := base.table.candidates(newStringInput(test.input), 0); mask != test.mask {
+			t.Errorf("input=%q expected=%04b actual=%04b", test.input, test.mask, mask)
+		}
+	}
+}
+
+func TestOptimizedOhmGrammar(t *testing.T) {
+	res, err := OhmGrammar.Optimize().MatchesRule("Grammars", ohmGrammarSource)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !res {
+		t.Errorf("expected=true actual=false")
+	}
+}
+
+func alternatives(expr PExpr) []PExpr {
+	switch e := expr.(type) {
+	case *Alt:
+		return e.exprs
+	case *DispatchAlt:
+		return e.exprs
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,145 @@
+package ohm
+
+import "context"
+
+// MatchOptions configures a single match.
+type MatchOptions struct {
+	// Memo overrides the grammar's memoization policies.
+	Memo *MemoConfig
+
+	// ProfileMemo collects per-rule memo statistics, which are available
+	// from MatchResult.MemoProfile.
+	ProfileMemo bool
+
+	// Prefix matches the rule without requiring the end of the input after
+	// it. The result's End is where the rule's match ended.
+	Prefix bool
+
+	// LongestPrefix reports how much of the input the rule matched when a
+	// full match fails. See MatchResult.PrefixEnd.
+	LongestPrefix bool
+
+	// InvalidUTF8 controls how invalid UTF-8 in the input is read.
+	InvalidUTF8 InvalidUTF8
+
+	// Context cancels the match when it's done, with a CanceledError.
+	Context context.Context
+
+	// MaxSteps limits how many steps a match takes, where a step is a rule
+	// application, including one found in the memo table, or an iteration
+	// of a repetition. MaxDepth limits how deeply applications nest.
+	// MaxMemoEntries limits how many memoized results are held at once.
+	// Exceeding a limit stops the match with a StepLimitError,
+	// DepthLimitError or MemoLimitError. Zero means no limit. Optimized
+	// grammars inline some rules, so they count fewer applications.
+	MaxSteps       int
+	MaxDepth       int
+	MaxMemoEntries int
+
+	// memo and appIDs are kept between matches, for Matcher and for
+	// LongestPrefix, as are lim's counts. start is where to start matching.
+	memo   *memoTable
+	appIDs map[string]int32
+	lim    *limits
+	start  int
+}
+
+// memoDecision caches whether a rule is memoized.
+type memoDecision int8
+
+const (
+	memoUndecided memoDecision = iota
+	memoYes
+	memoNo
+)
+
+// memoTable returns the memo table to use for the match: the one kept
+// between matches if there is one, or else spare, which is reset or
+// allocated.
+func (opts *MatchOptions) memoTable(spare **memoTable) *memoTable {
+	if opts.memo != nil {
+		return opts.memo
+	}
+	if *spare == nil {
+		*spare = &memoTable{}
+	} else {
+		(*spare).reset()
+	}
+	return *spare
+}
+
+func (opts *MatchOptions) setup(m *MatchState) {
+	m.appIDs = opts.appIDs
+	m.memoRules = newMemoResolver(m.g, opts.Memo)
+	m.limits = opts.limits()
+	if opts.ProfileMemo {
+		m.profile = make(MemoProfile)
+	}
+}
+
+// memoizes reports whether applications of a are memoized.
+func (m *MatchState) memoizes(a *Apply) bool {
+	if m.memoRules == nil {
+		return true
+	}
+
+	id := int(a.ruleID())
+	for id >= len(m.memoDecisions) {
+		m.memoDecisions = append(m.memoDecisions, memoUndecided)
+	}
+
+	if m.memoDecisions[id] == memoUndecided {
+		m.memoDecisions[id] = decide(m.memoRules.memoizes(a.name))
+	}
+	return m.memoDecisions[id] == memoYes
+}
+
+func decide(b bool) memoDecision {
+	if b {
+		return memoYes
+	}
+	return memoNo
+}
+
+// decideAll decides whether to memoize each instantiation of a compiled
+// grammar, or returns nil if they're all memoized.
+func decideAll(r *memoResolver, names []string) []memoDecision {
+	if r == nil {
+		return nil
+	}
+
+	decisions := make([]memoDecision, len(names))
+	for i, name := range names {
+		decisions[i] = decide(r.memoizes(name))
+	}
+	return decisions
+}
+
+// withLongestPrefix calls match, which matches in with opts. If the match
+// fails and opts asks for the longest prefix, the rule is matched again as a
+// prefix. It shares the memo table with the first match, so this mostly
+// looks up memoized results.
+func withLongestPrefix(in *inputBuffer, opts MatchOptions, match func(*inputBuffer, MatchOptions) (*MatchResult, error)) (*MatchResult, error) {
+	if !opts.LongestPrefix || opts.Prefix || in.r != nil {
+		return match(in, opts)
+	}
+
+	if opts.memo == nil {
+		opts.memo = &memoTable{}
+		opts.appIDs = make(map[string]int32)
+	}
+	opts.lim = opts.limits()
+	res, err := match(in, opts)
+	if err != nil || res.succeeded {
+		return res, err
+	}
+
+	opts.Prefix = true
+	prefix, err := match(in.restart(), opts)
+	if err != nil {
+		return nil, err
+	}
+	res.prefix = prefix.succeeded
+	res.prefixEnd = prefix.end
+	return res, nil
+}
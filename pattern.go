@@ -0,0 +1,174 @@
+package ohm
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Pattern searches text for matches of a grammar rule, with methods like
+// those of regexp.Regexp. The rule is tried at every position, so it can
+// find things regular expressions can't, like balanced brackets. Matches
+// don't have to be followed by the end of the input. Matches of syntactic
+// rules start after any spaces they skip.
+//
+// Unlike with regexp.Regexp, matching can fail with an error, for instance
+// on invalid UTF-8.
+type Pattern struct {
+	g       *Grammar
+	rule    string
+	lexical bool
+}
+
+// Pattern returns a Pattern that matches the rule called name.
+func (g *Grammar) Pattern(name string) (*Pattern, error) {
+	lexical, err := (&Apply{name: name}).isLexical()
+	if err != nil {
+		return nil, err
+	}
+
+	for sg := g; sg != nil; sg = sg.super {
+		if sg.rules[name] != nil {
+			return &Pattern{g: g, rule: name, lexical: lexical}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown rule \"%s\"", name)
+}
+
+// FindIndex returns the start and end of the leftmost match in b, or nil if
+// there's no match.
+func (p *Pattern) FindIndex(b []byte) ([]int, error) {
+	locs, err := p.findAll(string(b), 1)
+	if err != nil || len(locs) == 0 {
+		return nil, err
+	}
+	return locs[0], nil
+}
+
+// FindAllIndex returns the start and end of successive non-overlapping
+// matches in b. If n >= 0, it returns at most n matches.
+func (p *Pattern) FindAllIndex(b []byte, n int) ([][]int, error) {
+	return p.findAll(string(b), n)
+}
+
+// FindAllString returns successive non-overlapping matches in s. If n >= 0,
+// it returns at most n matches.
+func (p *Pattern) FindAllString(s string, n int) ([]string, error) {
+	locs, err := p.findAll(s, n)
+	if err != nil || len(locs) == 0 {
+		return nil, err
+	}
+
+	matches := make([]string, len(locs))
+	for i, loc := range locs {
+		matches[i] = s[loc[0]:loc[1]]
+	}
+	return matches, nil
+}
+
+// ReplaceAllFunc returns a copy of src with every match replaced by the
+// result of calling repl on it.
+func (p *Pattern) ReplaceAllFunc(src []byte, repl func([]byte) []byte) ([]byte, error) {
+	locs, err := p.findAll(string(src), -1)
+	if err != nil {
+		return nil, err
+	}
+
+	var dst []byte
+	last := 0
+	for _, loc := range locs {
+		dst = append(dst, src[last:loc[0]]...)
+		dst = append(dst, repl(src[loc[0]:loc[1]])...)
+		last = loc[1]
+	}
+	return append(dst, src[last:]...), nil
+}
+
+// Split slices s into the substrings between matches, like
+// regexp.Regexp.Split. If n >= 0, it returns at most n substrings, and the
+// last one is the rest of s.
+func (p *Pattern) Split(s string, n int) ([]string, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	if len(s) == 0 {
+		return []string{""}, nil
+	}
+
+	locs, err := p.findAll(s, n)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]string, 0, len(locs))
+	beg, end := 0, 0
+	for _, loc := range locs {
+		if n > 0 && len(parts) == n-1 {
+			break
+		}
+		end = loc[0]
+		if loc[1] != 0 {
+			parts = append(parts, s[beg:end])
+		}
+		beg = loc[1]
+	}
+	if end != len(s) {
+		parts = append(parts, s[beg:])
+	}
+	return parts, nil
+}
+
+// findAll returns the locations of up to n matches in s, or all of them if n
+// is negative. Like regexp.Regexp, an empty match right after another match
+// is ignored. The rule is applied with a Matcher, so results memoized while
+// trying one position are reused at the next ones.
+func (p *Pattern) findAll(s string, n int) ([][]int, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	m := p.g.Matcher()
+	m.SetInput(s)
+
+	var locs [][]int
+	prevEnd := -1
+	for pos := 0; pos <= len(s) && (n < 0 || len(locs) < n); {
+		start, end, ok, err := p.matchAt(m, pos)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok && !(end == start && start == prevEnd) {
+			locs = append(locs, []int{start, end})
+			prevEnd = end
+		}
+
+		if ok && end > pos {
+			pos = end
+		} else if pos < len(s) {
+			_, size := utf8.DecodeRuneInString(s[pos:])
+			pos += size
+		} else {
+			break
+		}
+	}
+	return locs, nil
+}
+
+// matchAt applies the rule at pos, returning where its match starts and
+// ends.
+func (p *Pattern) matchAt(m *Matcher, pos int) (start, end int, ok bool, err error) {
+	start = pos
+	if !p.lexical {
+		res, err := m.MatchAt("spaces", pos)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		start = res.End()
+	}
+
+	res, err := m.MatchAt(p.rule, pos)
+	if err != nil || !res.Succeeded() {
+		return 0, 0, false, err
+	}
+	return start, res.End(), true, nil
+}
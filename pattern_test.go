@@ -0,0 +1,144 @@
+package ohm
+
+import (
+	"bytes"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestPatternLikeRegexp(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"digits":    &Plus{apply("digit")},
+		"maybe":     &Star{apply("digit")},
+		"separator": seq(lit(","), &Star{lit(" ")}),
+	})
+
+	tests := []struct {
+		rule string
+		re   string
+	}{
+		{"digits", `[0-9]+`},
+		{"maybe", `[0-9]*`},
+		{"separator", `, *`},
+	}
+	inputs := []string{"", "a", "12", "a1b22c333", "1,2, 3,,  é4", ",x,"}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		for _, test := range tests {
+			p, err := g.Pattern(test.rule)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			re := regexp.MustCompile(test.re)
+
+			for _, input := range inputs {
+				testPatternLikeRegexp(t, names[i]+" "+test.rule, p, re, input)
+			}
+		}
+	}
+}
+
+func testPatternLikeRegexp(t *testing.T, name string, p *Pattern, re *regexp.Regexp, input string) {
+	t.Helper()
+
+	loc, err := p.FindIndex([]byte(input))
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %s", name, err)
+	}
+	if expected := re.FindIndex([]byte(input)); !reflect.DeepEqual(loc, expected) {
+		t.Errorf("%s: FindIndex(%q) expected=%v actual=%v", name, input, expected, loc)
+	}
+
+	for _, n := range []int{-1, 0, 1, 2} {
+		locs, err := p.FindAllIndex([]byte(input), n)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		if expected := re.FindAllIndex([]byte(input), n); !reflect.DeepEqual(locs, expected) {
+			t.Errorf("%s: FindAllIndex(%q, %d) expected=%v actual=%v", name, input, n, expected, locs)
+		}
+
+		matches, err := p.FindAllString(input, n)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		if expected := re.FindAllString(input, n); !reflect.DeepEqual(matches, expected) {
+			t.Errorf("%s: FindAllString(%q, %d) expected=%q actual=%q", name, input, n, expected, matches)
+		}
+
+		parts, err := p.Split(input, n)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		if expected := re.Split(input, n); !reflect.DeepEqual(parts, expected) {
+			t.Errorf("%s: Split(%q, %d) expected=%q actual=%q", name, input, n, expected, parts)
+		}
+	}
+
+	repl := func(b []byte) []byte { return append([]byte("<"), append(bytes.ToUpper(b), '>')...) }
+	replaced, err := p.ReplaceAllFunc([]byte(input), repl)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %s", name, err)
+	}
+	if expected := re.ReplaceAllFunc([]byte(input), repl); !bytes.Equal(replaced, expected) {
+		t.Errorf("%s: ReplaceAllFunc(%q) expected=%q actual=%q", name, input, expected, replaced)
+	}
+}
+
+func TestPatternBalanced(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"parens": seq(lit("("), &Star{&Alt{[]PExpr{
+			apply("parens"),
+			seq(&Not{&Alt{[]PExpr{lit("("), lit(")")}}}, &Any{}),
+		}}}, lit(")")),
+		"List": seq(lit("["), &Star{apply("digit")}, lit("]")),
+	})
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		p, err := g.Pattern("parens")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		matches, err := p.FindAllString("f(a, (b)) + (g(c) ((", -1)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if expected := []string{"(a, (b))", "(c)"}; !reflect.DeepEqual(matches, expected) {
+			t.Errorf("%s: expected=%q actual=%q", names[i], expected, matches)
+		}
+
+		// Matches of syntactic rules don't include the spaces before them.
+		p, err = g.Pattern("List")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		locs, err := p.FindAllIndex([]byte("x  [1 2] [ ]"), -1)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if expected := [][]int{{3, 8}, {9, 12}}; !reflect.DeepEqual(locs, expected) {
+			t.Errorf("%s: expected=%v actual=%v", names[i], expected, locs)
+		}
+	}
+}
+
+func TestPatternErrors(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"word": &Plus{apply("letter")},
+	})
+
+	if _, err := g.Pattern("missing"); err == nil || err.Error() != `unknown rule "missing"` {
+		t.Errorf("expected an unknown rule error, got %v", err)
+	}
+
+	p, err := g.Pattern("word")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := p.FindAllString("ab \xff", -1); err == nil {
+		t.Errorf("expected an error for invalid UTF-8")
+	}
+}
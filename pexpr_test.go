@@ -30,7 +30,7 @@ func maybe(expr PExpr) PExpr {
 }
 
 func apply(name string, args ...PExpr) PExpr {
-	return &Apply{name, args}
+	return &Apply{name: name, args: args}
 }
 
 func param(n int) PExpr {
@@ -46,16 +46,33 @@ type test struct {
 	matches bool
 }
 
+var backends = []Backend{BackendInterpreter, BackendMachine, BackendClosures}
+
+// variants returns g matched with every backend, both as is and optimized,
+// along with a name for each one. Every backend has to agree with the
+// interpreter.
+func variants(g *Grammar) (names []string, grammars []*Grammar) {
+	optimized := g.Optimize()
+	for _, b := range backends {
+		names = append(names, b.String(), b.String()+"/optimized")
+		grammars = append(grammars, g.WithBackend(b), optimized.WithBackend(b))
+	}
+	return names, grammars
+}
+
 func testMatchesRule(t *testing.T, g *Grammar, rule string, tests []test) {
 	t.Helper()
 
-	for _, test := range tests {
-		res, err := g.MatchesRule(rule, test.input)
-		if err != nil {
-			t.Fatalf("unexpected error: %s", err)
-		}
-		if test.matches != res {
-			t.Errorf("input=\"%s\" expected=%v actual=%v", test.input, test.matches, res)
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		for _, test := range tests {
+			res, err := g.MatchesRule(rule, test.input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if test.matches != res {
+				t.Errorf("%s: input=\"%s\" expected=%v actual=%v", names[i], test.input, test.matches, res)
+			}
 		}
 	}
 }
@@ -129,6 +146,24 @@ func TestSyntacticAlt(t *testing.T) {
 	testMatchesRule(t, g, "Start", tests)
 }
 
+func TestSkipSpacesBeforeEachExpr(t *testing.T) {
+	// With spaces overridden to skip at most one space, you can see that
+	// spaces are skipped before every nested expression: before lit("b"),
+	// and again before the Char inside it.
+	g := grammar(map[string]PExpr{
+		"Start":  seq(lit("a"), lit("b")),
+		"spaces": maybe(apply("space")),
+	})
+
+	tests := []test{
+		{"ab", true},
+		{"a b", true},
+		{"a  b", true},
+		{"a   b", false},
+	}
+	testMatchesRule(t, g, "Start", tests)
+}
+
 func TestLexOpt(t *testing.T) {
 	g := grammar(map[string]PExpr{
 		"start": seq(lit("aa"), maybe(lit("bb")), lit("cc")),
@@ -273,6 +308,51 @@ func TestMaybe(t *testing.T) {
 	testMatchesRule(t, g, "start", tests)
 }
 
+func TestRepeat(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"bounded": seq(&Repeat{expr: lit("a"), min: 2, max: 3}, lit("b")),
+		"exact":   &Repeat{expr: lit("ab"), min: 2, max: 2},
+		"atLeast": seq(&Repeat{expr: lit("a"), min: 2, max: -1}, lit("b")),
+		"Words":   seq(&Repeat{expr: apply("letter"), min: 0, max: 2}, lit(";")),
+	})
+
+	testMatchesRule(t, g, "bounded", []test{
+		{"ab", false},
+		{"aab", true},
+		{"aaab", true},
+		{"aaaab", false},
+	})
+	testMatchesRule(t, g, "exact", []test{
+		{"ab", false},
+		{"abab", true},
+		{"ababab", false},
+	})
+	testMatchesRule(t, g, "atLeast", []test{
+		{"ab", false},
+		{"aab", true},
+		{"aaaaab", true},
+	})
+	testMatchesRule(t, g, "Words", []test{
+		{";", true},
+		{"a b ;", true},
+		{"a b c;", false},
+	})
+}
+
+func TestRepeatInvalidBounds(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start": &Repeat{expr: lit("a"), min: 3, max: 1},
+	})
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		_, err := g.MatchesRule("start", "aaa")
+		if err == nil || err.Error() != "invalid repetition bounds: {3,1}" {
+			t.Errorf("%s: expected an invalid bounds error, got %v", names[i], err)
+		}
+	}
+}
+
 func TestApply(t *testing.T) {
 	g := grammar(map[string]PExpr{
 		"Start": seq(apply("foo"), lit("bar")),
@@ -334,6 +414,23 @@ func TestSyntacticApplyWithArgs(t *testing.T) {
 	testMatchesRule(t, g, "Start", tests)
 }
 
+func TestApplyWithDifferentArgs(t *testing.T) {
+	// Both alternatives apply twice at position 0. They have to be memoized
+	// separately.
+	g := grammar(map[string]PExpr{
+		"start": alt(seq(apply("twice", lit("a")), lit("x")), apply("twice", lit("b"))),
+		"twice": seq(param(0), param(0)),
+	})
+
+	tests := []test{
+		{"aax", true},
+		{"bb", true},
+		{"aa", false},
+		{"ab", false},
+	}
+	testMatchesRule(t, g, "start", tests)
+}
+
 // TODO:
 // - Param
 // - left recursion
@@ -0,0 +1,89 @@
+package ohm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PredicateFunc decides whether text, which was just matched, is accepted.
+// It's called from every goroutine the grammar is matched from, and should
+// always give the same answer for the same text, since results that depend
+// on it are memoized.
+type PredicateFunc func(text string) bool
+
+// WithPredicate returns a grammar like g with a rule called name with one
+// parameter, which matches its argument and then fails unless fn accepts
+// the text it matched. For example, if fn accepts numbers up to 65535,
+// name<digit+> matches a port number. For a TokenStream, the text is the
+// values of the matched tokens separated by spaces.
+func (g *Grammar) WithPredicate(name string, fn PredicateFunc) (*Grammar, error) {
+	if _, err := (&Apply{name: name}).isLexical(); err != nil {
+		return nil, err
+	}
+
+	rules := make(map[string]PExpr, len(g.rules)+1)
+	for rule, body := range g.rules {
+		rules[rule] = body
+	}
+	rules[name] = &SemanticPredicate{name: name, expr: &Param{0}, fn: fn}
+
+	return g.derive(rules), nil
+}
+
+// SemanticPredicate matches expr, and then fails unless fn accepts the text
+// it matched. See WithPredicate.
+type SemanticPredicate struct {
+	name string
+	expr PExpr
+	fn   PredicateFunc
+}
+
+func (p *SemanticPredicate) Eval(m *MatchState) (bool, error) {
+	// Nothing is released while matching expr, so the text it matched is
+	// still there to check.
+	start := m.pos
+	m.choices++
+	m.preds++
+	res, err := m.eval(p.expr)
+	m.choices--
+	m.preds--
+	if err != nil || !res {
+		return false, err
+	}
+
+	return p.check(m.in, start, m.pos)
+}
+
+// check reports whether fn accepts the input between start and end.
+func (p *SemanticPredicate) check(in *inputBuffer, start, end int) (bool, error) {
+	text, err := in.text(start, end)
+	if err != nil {
+		return false, err
+	}
+	return p.fn(text), nil
+}
+
+func (p *SemanticPredicate) substituteParams(args []PExpr) (PExpr, error) {
+	newExpr, err := p.expr.substituteParams(args)
+	if err != nil {
+		return nil, err
+	}
+	return &SemanticPredicate{name: p.name, expr: newExpr, fn: p.fn}, nil
+}
+
+// text returns the input between start and end, or the values of the
+// tokens between them separated by spaces.
+func (in *inputBuffer) text(start, end int) (string, error) {
+	if in.tokens != nil {
+		var values []string
+		for i := start; i < end; i++ {
+			values = append(values, in.tokens.Token(i).Value)
+		}
+		return strings.Join(values, " "), nil
+	}
+
+	if start < in.base {
+		return "", fmt.Errorf("input at pos %d was already released", start)
+	}
+	return in.s[start-in.base : end-in.base], nil
+}
@@ -0,0 +1,131 @@
+package ohm
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func predicateGrammar(t *testing.T, calls *int) *Grammar {
+	t.Helper()
+
+	g := grammar(map[string]PExpr{
+		"Addr": seq(apply("Name"), lit(":"), &Apply{name: "port", args: []PExpr{&Plus{apply("digit")}}}),
+		"Name": &Apply{name: "Unreserved", args: []PExpr{apply("ident")}},
+		"Pair": alt(
+			seq(apply("Addr"), lit("!")),
+			seq(apply("Addr"), lit("?")),
+		),
+		"ident": &Plus{apply("letter")},
+	})
+
+	g, err := g.WithPredicate("port", func(text string) bool {
+		*calls++
+		n, err := strconv.Atoi(text)
+		return err == nil && n <= 65535
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	g, err = g.WithPredicate("Unreserved", func(text string) bool {
+		return text != "if" && text != "else"
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return g
+}
+
+func TestSemanticPredicate(t *testing.T) {
+	var calls int
+	testMatchesRule(t, predicateGrammar(t, &calls), "Addr", []test{
+		{"host:80", true},
+		{"  host : 65535", true},
+		{"host:65536", false},
+		{"host:", false},
+		{"if:80", false},
+		{"iff:80", true},
+		{"else:80", false},
+	})
+}
+
+// TestSemanticPredicateMemo checks that a predicate's result is memoized
+// along with the rule it's in, so backtracking doesn't call it again.
+func TestSemanticPredicateMemo(t *testing.T) {
+	tests := []struct {
+		input   string
+		matches bool
+	}{
+		{"host:80?", true},
+		{"host:99999?", false},
+	}
+
+	var calls int
+	names, grammars := variants(predicateGrammar(t, &calls))
+	for i, g := range grammars {
+		for _, test := range tests {
+			calls = 0
+			res, err := g.MatchesRule("Pair", test.input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res != test.matches {
+				t.Errorf("%s: input=%q expected=%v actual=%v", names[i], test.input, test.matches, res)
+			}
+			if calls != 1 {
+				t.Errorf("%s: input=%q expected 1 call, got %d", names[i], test.input, calls)
+			}
+		}
+	}
+}
+
+func TestSemanticPredicateTokens(t *testing.T) {
+	g, err := grammar(map[string]PExpr{
+		"Exp": &Apply{name: "Small", args: []PExpr{seq(&TokenMatch{kind: "INT"}, &TokenMatch{kind: "+"}, &TokenMatch{kind: "INT"})}},
+	}).WithPredicate("Small", func(text string) bool {
+		return text == "1 + 2"
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		for input, expected := range map[string]bool{"1+2": true, "1 + 3": false} {
+			res, err := g.MatchTokens("Exp", scanGo(t, input))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res.Succeeded() != expected {
+				t.Errorf("%s: input=%q expected=%v actual=%v", names[i], input, expected, res.Succeeded())
+			}
+		}
+	}
+}
+
+// TestSemanticPredicateReader checks that input isn't released while a
+// predicate's expression is matched, even past a cut.
+func TestSemanticPredicateReader(t *testing.T) {
+	const n = 100000
+	g, err := grammar(map[string]PExpr{
+		"lines": &Star{seq(&Apply{name: "long", args: []PExpr{seq(&Plus{apply("digit")}, &Cut{}, &Star{lit("x")})}}, lit("\n"))},
+	}).WithPredicate("long", func(text string) bool {
+		return len(text) == 2*n
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		input := strings.Repeat(strings.Repeat("7", n)+strings.Repeat("x", n)+"\n", 3)
+		res, err := g.MatchReader(context.Background(), strings.NewReader(input), "lines")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() {
+			t.Errorf("%s: expected a match", names[i])
+		}
+	}
+}
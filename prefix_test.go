@@ -0,0 +1,71 @@
+package ohm
+
+import "testing"
+
+func prefixGrammar() *Grammar {
+	return grammar(map[string]PExpr{
+		"Stmt":   seq(apply("Expr"), lit(";")),
+		"Expr":   seq(apply("number"), &Star{seq(lit("+"), apply("number"))}),
+		"number": &Plus{apply("digit")},
+	})
+}
+
+func TestMatchPrefix(t *testing.T) {
+	tests := []struct {
+		input   string
+		matches bool
+		end     int
+	}{
+		{"1 + 2; 3", true, 6},
+		{"1;", true, 2},
+		{"1 +", false, 0},
+		{"", false, 0},
+	}
+
+	names, grammars := variants(prefixGrammar())
+	for i, g := range grammars {
+		for _, test := range tests {
+			res, err := g.MatchPrefix("Stmt", test.input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res.Succeeded() != test.matches || res.End() != test.end {
+				t.Errorf("%s: input=%q expected=(%v %d) actual=(%v %d)", names[i], test.input, test.matches, test.end, res.Succeeded(), res.End())
+			}
+		}
+	}
+}
+
+func TestLongestPrefix(t *testing.T) {
+	tests := []struct {
+		input      string
+		matches    bool
+		prefix     bool
+		prefixEnd  int
+		incomplete bool
+	}{
+		{"1 + 2;", true, false, 0, false},
+		{"1 + 2; 3", false, true, 6, false},
+		{"1 + 2", false, false, 0, true},
+		{"1 +", false, false, 0, true},
+		{"1 + )", false, false, 0, false},
+	}
+
+	names, grammars := variants(prefixGrammar())
+	for i, g := range grammars {
+		for _, test := range tests {
+			res, err := g.MatchWithOptions("Stmt", test.input, MatchOptions{LongestPrefix: true})
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+
+			end, ok := res.PrefixEnd()
+			if res.Succeeded() != test.matches || ok != test.prefix || end != test.prefixEnd {
+				t.Errorf("%s: input=%q expected=(%v %v %d) actual=(%v %v %d)", names[i], test.input, test.matches, test.prefix, test.prefixEnd, res.Succeeded(), ok, end)
+			}
+			if res.Incomplete() != test.incomplete {
+				t.Errorf("%s: input=%q incomplete: expected=%v actual=%v", names[i], test.input, test.incomplete, res.Incomplete())
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package ohm
+
+// raceEnabled is set when testing with the race detector, which makes
+// sync.Pool drop items at random.
+const raceEnabled = true
@@ -0,0 +1,143 @@
+package ohm
+
+import "fmt"
+
+// WithRecovery returns a grammar like g where the rule called name recovers
+// from failing by skipping ahead to the next place the rule called sync
+// matches. It then succeeds, matching everything up to the end of sync's
+// match, and the skipped input is reported as a Diagnostic, so a match can
+// find more than one syntax error. For example, with
+//
+//	stmtEnd = ";" | &"}" | end
+//
+// as sync, a Statement that fails skips past the next semicolon, or up to
+// the end of its block.
+//
+// Recovery only happens if something is skipped, so where sync matches the
+// empty string, like before "}" above, name still fails, which ends a
+// repetition of Statements. The first place sync matches decides. Rules
+// whose failure is expected, like alternatives that are tried in turn,
+// shouldn't recover, and lookaheads see a recovered match as a match. Cuts
+// made while matching name don't affect anything outside it, and the input
+// it matches is kept in memory until it's done. In a byte rule, input is
+// skipped a byte at a time, whether WithByteMode is called before or after
+// WithRecovery.
+func (g *Grammar) WithRecovery(name, sync string) (*Grammar, error) {
+	var bodies []PExpr
+	for _, rule := range []string{name, sync} {
+		var body PExpr
+		for sg := g; sg != nil && body == nil; sg = sg.super {
+			body = sg.rules[rule]
+		}
+		if body == nil {
+			return nil, fmt.Errorf("unknown rule \"%s\"", rule)
+		}
+		bodies = append(bodies, body)
+	}
+
+	rules := make(map[string]PExpr, len(g.rules)+1)
+	for rule, expr := range g.rules {
+		rules[rule] = expr
+	}
+	rules[name] = &Recover{name: name, expr: bodies[0], sync: &Apply{name: sync}, bytes: g.bytes[name]}
+
+	return g.derive(rules), nil
+}
+
+// Diagnostic is a syntax error that a match recovered from. The input
+// between Start and End was skipped after Rule failed there. See
+// WithRecovery. This package doesn't build CSTs, so skipped input is only
+// reported as Diagnostics, not as error nodes in a tree.
+type Diagnostic struct {
+	Rule       string
+	Start, End int
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: syntax error at %d, skipped to %d", d.Rule, d.Start, d.End)
+}
+
+// Recover matches expr, or if it fails, skips past the next match of sync
+// and records a Diagnostic. In a byte rule, input is skipped a byte at a
+// time. See WithRecovery.
+type Recover struct {
+	name  string
+	expr  PExpr
+	sync  *Apply
+	bytes bool
+}
+
+func (r *Recover) Eval(m *MatchState) (bool, error) {
+	// Like a lookahead, nothing is released while matching expr, since
+	// recovering starts over from start, and its cuts are undone.
+	start, cut := m.pos, m.cut
+	m.choices++
+	m.preds++
+	res, err := m.eval(r.expr)
+	m.choices--
+	m.preds--
+	m.cut = cut
+	if err != nil || res {
+		return res, err
+	}
+
+	return r.recover(m, start, func(m *MatchState) (bool, error) {
+		return m.eval(r.sync)
+	})
+}
+
+// recover skips from start past the next match of sync and records a
+// Diagnostic, or fails if nothing was skipped.
+func (r *Recover) recover(m *MatchState, start int, sync matchFunc) (bool, error) {
+	// Like a semantic predicate, nothing is released while skipping.
+	m.choices++
+	m.preds++
+	res, err := skipPast(m, start, sync, r.bytes)
+	m.choices--
+	m.preds--
+	if err != nil || !res {
+		return false, err
+	}
+
+	m.diagnostics = append(m.diagnostics, Diagnostic{Rule: r.name, Start: start, End: m.pos})
+	return true, nil
+}
+
+// skipPast skips from start past the next match of sync, a rune or a byte at
+// a time, reporting whether anything was skipped. Like the choices in a
+// repetition, trying sync somewhere that a cut was made past ends the
+// search.
+func skipPast(m *MatchState, start int, sync matchFunc, bytes bool) (bool, error) {
+	for pos := start; ; {
+		res, err := try(m, sync)
+		if err != nil {
+			return false, err
+		}
+		if res {
+			return m.pos > start, nil
+		}
+		if m.cutPast(pos) {
+			return false, nil
+		}
+
+		size := 1
+		if bytes {
+			_, more, err := m.in.peekByte(pos)
+			if err != nil || !more {
+				return false, err
+			}
+		} else if _, size, err = m.in.peek(pos); err != nil || size == 0 {
+			return false, err
+		}
+		pos += size
+		m.pos = pos
+	}
+}
+
+func (r *Recover) substituteParams(args []PExpr) (PExpr, error) {
+	newExpr, err := r.expr.substituteParams(args)
+	if err != nil {
+		return nil, err
+	}
+	return &Recover{name: r.name, expr: newExpr, sync: r.sync, bytes: r.bytes}, nil
+}
@@ -0,0 +1,210 @@
+package ohm
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func recoveryGrammar(t *testing.T) *Grammar {
+	t.Helper()
+
+	g := grammar(map[string]PExpr{
+		"Program":   seq(&Star{apply("Statement")}, apply("end")),
+		"Statement": alt(apply("Let"), apply("Block"), seq(apply("ident"), lit("="), apply("number"), lit(";"))),
+		"Let":       seq(lit("let"), &Cut{}, apply("ident"), lit(";")),
+		"Block":     seq(lit("{"), &Star{apply("Statement")}, lit("}")),
+		"stmtEnd":   alt(lit(";"), &Lookahead{lit("}")}, apply("end")),
+		"ident":     &Plus{apply("letter")},
+		"number":    &Plus{apply("digit")},
+
+		// Top and Twice apply Statement in alternatives that fail after it.
+		"Top":   alt(seq(apply("Statement"), lit("!")), &Plus{&Any{}}),
+		"Twice": alt(seq(apply("Statement"), lit("?")), seq(apply("Statement"), lit("!"))),
+		"Ahead": seq(&Lookahead{apply("Statement")}, &Plus{&Any{}}),
+	})
+	g, err := g.WithRecovery("Statement", "stmtEnd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return g
+}
+
+func TestRecovery(t *testing.T) {
+	tests := []struct {
+		rule        string
+		input       string
+		matches     bool
+		diagnostics []Diagnostic
+	}{
+		{"Program", "a = 1; b = 2;", true, nil},
+		{"Program", "a = 1; b = ; c = 3;", true, []Diagnostic{{"Statement", 7, 12}}},
+		{"Program", "a = ; b = 2; c 3;", true, []Diagnostic{{"Statement", 0, 5}, {"Statement", 13, 17}}},
+		{"Program", "{ a = 1; x }", true, []Diagnostic{{"Statement", 9, 11}}},
+		{"Program", "{ a = 1; { } } b", true, []Diagnostic{{"Statement", 15, 16}}},
+		{"Program", "let 1; a = 2;", true, []Diagnostic{{"Statement", 0, 6}}},
+		{"Program", ";", true, []Diagnostic{{"Statement", 0, 1}}},
+		{"Program", "a = ; }", false, nil},
+		{"Top", "a = x;!", true, []Diagnostic{{"Statement", 0, 6}}},
+		{"Top", "a = x y;", true, nil},
+		{"Twice", "a = x; !", true, []Diagnostic{{"Statement", 0, 6}}},
+		{"Ahead", "a = x;", true, nil},
+	}
+
+	names, grammars := variants(recoveryGrammar(t))
+	for i, g := range grammars {
+		for _, test := range tests {
+			res, err := g.Match(test.rule, test.input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res.Succeeded() != test.matches {
+				t.Errorf("%s: rule=%s input=%q expected=%v actual=%v", names[i], test.rule, test.input, test.matches, res.Succeeded())
+			}
+			if !reflect.DeepEqual(res.Diagnostics(), test.diagnostics) {
+				t.Errorf("%s: rule=%s input=%q expected diagnostics %v, got %v", names[i], test.rule, test.input, test.diagnostics, res.Diagnostics())
+			}
+		}
+	}
+}
+
+// TestRecoveryMemo checks that applications that recovered from errors are
+// memoized, and that their diagnostics are replayed and moved by edits.
+func TestRecoveryMemo(t *testing.T) {
+	names, grammars := variants(recoveryGrammar(t))
+	for i, g := range grammars {
+		m := g.Matcher()
+		m.SetInput("a = ; b = 2; c 3;")
+
+		first, err := m.Match("Program")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		second, err := m.Match("Program")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		expected := []Diagnostic{{"Statement", 0, 5}, {"Statement", 13, 17}}
+		if !second.Succeeded() || !reflect.DeepEqual(second.Diagnostics(), expected) {
+			t.Errorf("%s: expected a match with diagnostics %v, got %v and %v", names[i], expected, second.Succeeded(), second.Diagnostics())
+		}
+		if second.MemoStats().Lookups*4 > first.MemoStats().Lookups {
+			t.Errorf("%s: expected far fewer lookups the second time, got %d then %d", names[i], first.MemoStats().Lookups, second.MemoStats().Lookups)
+		}
+
+		if err := m.ReplaceInputRange(6, 7, "bb"); err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		res, err := m.Match("Program")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		expected = []Diagnostic{{"Statement", 0, 5}, {"Statement", 14, 18}}
+		if !res.Succeeded() || !reflect.DeepEqual(res.Diagnostics(), expected) {
+			t.Errorf("%s: expected a match with diagnostics %v after an edit, got %v and %v", names[i], expected, res.Succeeded(), res.Diagnostics())
+		}
+	}
+}
+
+func TestRecoveryTokens(t *testing.T) {
+	g, err := grammar(map[string]PExpr{
+		"Stmts":   &Star{apply("Stmt")},
+		"Stmt":    seq(&TokenMatch{kind: "IDENT"}, &TokenMatch{kind: "="}, &TokenMatch{kind: "INT"}, &TokenMatch{kind: ";"}),
+		"stmtEnd": &TokenMatch{kind: ";"},
+	}).WithRecovery("Stmt", "stmtEnd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		res, err := g.MatchTokens("Stmts", scanGo(t, "a = 1; b = c; d = 2;"))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		expected := []Diagnostic{{"Stmt", 4, 8}}
+		if !res.Succeeded() || !reflect.DeepEqual(res.Diagnostics(), expected) {
+			t.Errorf("%s: expected a match with diagnostics %v, got %v and %v", names[i], expected, res.Succeeded(), res.Diagnostics())
+		}
+	}
+}
+
+// TestRecoveryReader checks that input is kept while a rule that might
+// recover is matched, even past a cut.
+func TestRecoveryReader(t *testing.T) {
+	const n = 100000
+	g, err := grammar(map[string]PExpr{
+		"lines":   &Star{apply("line")},
+		"line":    seq(&Plus{apply("digit")}, &Cut{}, &Star{lit("x")}, lit("\n")),
+		"lineEnd": lit("\n"),
+	}).WithRecovery("line", "lineEnd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		line := strings.Repeat("7", n) + strings.Repeat("x", n)
+		input := line + "\n" + line + "?\n" + line + "\n"
+		res, err := g.MatchReader(context.Background(), strings.NewReader(input), "lines")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		expected := []Diagnostic{{"line", 2*n + 1, 4*n + 3}}
+		if !res.Succeeded() || !reflect.DeepEqual(res.Diagnostics(), expected) {
+			t.Errorf("%s: expected a match with diagnostics %v, got %v and %v", names[i], expected, res.Succeeded(), res.Diagnostics())
+		}
+	}
+}
+
+// TestRecoveryBytes checks that a byte rule skips input a byte at a time
+// whether it's made a byte rule before or after it's made to recover.
+func TestRecoveryBytes(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"records":   &Star{apply("record")},
+		"record":    seq(lit("R"), &Any{}, lit(";")),
+		"recordEnd": lit(";"),
+	})
+
+	recoverFirst, err := g.WithRecovery("record", "recordEnd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	recoverFirst, err = recoverFirst.WithByteMode("record", "recordEnd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	bytesFirst, err := g.WithByteMode("record", "recordEnd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	bytesFirst, err = bytesFirst.WithRecovery("record", "recordEnd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, g := range []*Grammar{recoverFirst, bytesFirst} {
+		names, grammars := variants(g)
+		for i, g := range grammars {
+			res, err := g.Match("records", "Rx;R\xff\xfe;R\x80;")
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			expected := []Diagnostic{{"record", 3, 7}}
+			if !res.Succeeded() || !reflect.DeepEqual(res.Diagnostics(), expected) {
+				t.Errorf("%s: expected a match with diagnostics %v, got %v and %v", names[i], expected, res.Succeeded(), res.Diagnostics())
+			}
+		}
+	}
+}
+
+func TestWithRecoveryErrors(t *testing.T) {
+	if _, err := OhmGrammar.WithRecovery("Missing", "end"); err == nil || err.Error() != `unknown rule "Missing"` {
+		t.Errorf("expected an unknown rule error, got %v", err)
+	}
+	if _, err := OhmGrammar.WithRecovery("Rule", "missing"); err == nil || err.Error() != `unknown rule "missing"` {
+		t.Errorf("expected an unknown rule error, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package ohm
+
+// MatchResult is the result of matching an input against a grammar.
+type MatchResult struct {
+	succeeded bool
+	input     string
+	end       int
+
+	// incomplete is set if a failed match looked at the end of the input.
+	// prefix and prefixEnd are the result of matching a prefix after a
+	// failed match, for MatchOptions.LongestPrefix.
+	incomplete bool
+	prefix     bool
+	prefixEnd  int
+	stats      MemoStats
+	profile    MemoProfile
+
+	// tokens is the input if it was a TokenStream.
+	tokens TokenStream
+
+	// diagnostics holds the errors a successful match recovered from.
+	diagnostics []Diagnostic
+}
+
+func (m *MatchState) result(succeeded bool) *MatchResult {
+	return &MatchResult{
+		succeeded:   succeeded,
+		input:       m.in.all(),
+		end:         m.pos,
+		incomplete:  !succeeded && m.in.pastEnd(),
+		stats:       m.memo.stats(),
+		profile:     m.profile,
+		tokens:      m.in.tokens,
+		diagnostics: diagnostics(succeeded, m.diagnostics),
+	}
+}
+
+// diagnostics returns a copy of the diagnostics of a match, which only has
+// them if it succeeded.
+func diagnostics(succeeded bool, d []Diagnostic) []Diagnostic {
+	if !succeeded || len(d) == 0 {
+		return nil
+	}
+	return append([]Diagnostic(nil), d...)
+}
+
+// Succeeded reports whether the input matched.
+func (r *MatchResult) Succeeded() bool {
+	return r.succeeded
+}
+
+// Failed reports whether the input didn't match.
+func (r *MatchResult) Failed() bool {
+	return !r.succeeded
+}
+
+// Input returns the input that was matched, or "" if it was read with
+// MatchReader or was a TokenStream.
+func (r *MatchResult) Input() string {
+	return r.input
+}
+
+// End returns the offset just past the matched input, or where matching
+// started if it failed.
+func (r *MatchResult) End() int {
+	return r.end
+}
+
+// PrefixEnd returns where the rule's match ended when a full match with
+// MatchOptions.LongestPrefix failed. ok is false if the rule didn't match a
+// prefix of the input either, or if there was no failed match to report on.
+func (r *MatchResult) PrefixEnd() (end int, ok bool) {
+	return r.prefixEnd, r.prefix
+}
+
+// Incomplete reports whether a failed match looked at the end of the input.
+// If so, the input might be the start of an input that matches, like an
+// unfinished statement in a REPL.
+func (r *MatchResult) Incomplete() bool {
+	return r.incomplete
+}
+
+// MemoStats returns statistics about the memo table used during the match.
+func (r *MatchResult) MemoStats() MemoStats {
+	return r.stats
+}
+
+// MemoProfile returns per-rule memo statistics if they were requested with
+// MatchOptions.ProfileMemo, or nil otherwise.
+func (r *MatchResult) MemoProfile() MemoProfile {
+	return r.profile
+}
+
+// Diagnostics returns the syntax errors that a successful match recovered
+// from. See Grammar.WithRecovery.
+func (r *MatchResult) Diagnostics() []Diagnostic {
+	return r.diagnostics
+}
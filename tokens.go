@@ -0,0 +1,98 @@
+package ohm
+
+// Token is an element of a TokenStream. Start and End are its offsets in the
+// source it was read from.
+type Token struct {
+	Kind  string
+	Value string
+	Start int
+	End   int
+}
+
+// TokenStream is a sequence of tokens from a separate lexer, which can be
+// matched instead of text.
+type TokenStream interface {
+	Len() int
+	Token(i int) Token
+}
+
+// Tokens is a TokenStream held in a slice.
+type Tokens []Token
+
+func (t Tokens) Len() int {
+	return len(t)
+}
+
+func (t Tokens) Token(i int) Token {
+	return t[i]
+}
+
+// tokenRune is what a token is read as by the primitives that match runes.
+// It's past the runes used for invalid bytes, so it only matches any.
+const tokenRune = invalidByteBase + 0x100
+
+// MatchTokens matches tokens against the rule called name, followed by the
+// end of the tokens. Each token is one position in the input: any matches a
+// single token, TokenMatch matches tokens by kind and value, and primitives
+// that match text never match. Positions in the result are token indexes,
+// which MatchResult.SourceInterval maps back to the source.
+func (g *Grammar) MatchTokens(name string, tokens TokenStream) (*MatchResult, error) {
+	return g.MatchTokensWithOptions(name, tokens, MatchOptions{})
+}
+
+// MatchTokensWithOptions is like MatchTokens, configured by opts.
+func (g *Grammar) MatchTokensWithOptions(name string, tokens TokenStream, opts MatchOptions) (*MatchResult, error) {
+	return g.match(name, newTokenInput(tokens), opts)
+}
+
+// TokenMatch matches a single token with the given kind, or of any kind if
+// kind is empty, and the given value, or any value if value is empty.
+type TokenMatch struct {
+	kind  string
+	value string
+}
+
+func (t *TokenMatch) Eval(m *MatchState) (bool, error) {
+	tok, ok := m.in.token(m.pos)
+	if !ok || !t.matches(tok) {
+		return false, nil
+	}
+
+	m.pos++
+	return true, nil
+}
+
+func (t *TokenMatch) matches(tok Token) bool {
+	return (t.kind == "" || tok.Kind == t.kind) && (t.value == "" || tok.Value == t.value)
+}
+
+func (t *TokenMatch) substituteParams(args []PExpr) (PExpr, error) {
+	return t, nil
+}
+
+// SourceInterval maps the token positions start and end, like 0 and End
+// after matching a TokenStream, to offsets in the tokens' source. The
+// interval covers the tokens from start up to end, or is empty at the start
+// of the token at start if there are none. For other inputs, start and end
+// are returned as they are.
+func (r *MatchResult) SourceInterval(start, end int) (int, int) {
+	if r.tokens == nil {
+		return start, end
+	}
+
+	n := r.tokens.Len()
+	if n == 0 {
+		return 0, 0
+	}
+
+	var srcStart int
+	if start < n {
+		srcStart = r.tokens.Token(start).Start
+	} else {
+		srcStart = r.tokens.Token(n - 1).End
+	}
+	if end <= start {
+		return srcStart, srcStart
+	}
+	return srcStart, r.tokens.Token(min(end, n) - 1).End
+}
@@ -0,0 +1,137 @@
+package ohm
+
+import (
+	"go/scanner"
+	"go/token"
+	"testing"
+)
+
+// scanGo tokenizes src with go/scanner, leaving out automatically inserted
+// semicolons.
+func scanGo(t *testing.T, src string) Tokens {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+
+	var s scanner.Scanner
+	s.Init(file, []byte(src), nil, 0)
+
+	var tokens Tokens
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			return tokens
+		}
+		if tok == token.SEMICOLON && lit == "\n" {
+			continue
+		}
+
+		value := lit
+		if value == "" {
+			value = tok.String()
+		}
+		start := file.Offset(pos)
+		tokens = append(tokens, Token{Kind: tok.String(), Value: value, Start: start, End: start + len(value)})
+	}
+}
+
+func goExprGrammar() *Grammar {
+	return grammar(map[string]PExpr{
+		"Exp": seq(apply("Term"), &Star{seq(&TokenMatch{kind: "+"}, apply("Term"))}),
+		"Term": &Alt{[]PExpr{
+			apply("Call"),
+			&TokenMatch{kind: "IDENT"},
+			&TokenMatch{kind: "INT"},
+		}},
+		"Call": seq(
+			&TokenMatch{kind: "IDENT"},
+			&TokenMatch{kind: "("},
+			&Apply{name: "ListOf", args: []PExpr{apply("Exp"), &TokenMatch{kind: ","}}},
+			&TokenMatch{kind: ")"},
+		),
+		"Nil":      &TokenMatch{value: "nil"},
+		"anything": &Star{&Any{}},
+		"text":     lit("f"),
+	})
+}
+
+func TestMatchTokens(t *testing.T) {
+	tests := []struct {
+		rule    string
+		input   string
+		matches bool
+	}{
+		{"Exp", "f(x, 1) + y", true},
+		{"Exp", "f(g(), 2)\n+ 3", true},
+		{"Exp", "f(x,, 1)", false},
+		{"Exp", "f(x", false},
+		{"Exp", "", false},
+		{"Nil", "nil", true},
+		{"Nil", "null", false},
+		{"anything", "f(x,, 1)", true},
+		{"text", "f", false},
+	}
+
+	names, grammars := variants(goExprGrammar())
+	for i, g := range grammars {
+		for _, test := range tests {
+			res, err := g.MatchTokens(test.rule, scanGo(t, test.input))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", names[i], err)
+			}
+			if res.Succeeded() != test.matches {
+				t.Errorf("%s: rule=%s input=%q expected=%v actual=%v", names[i], test.rule, test.input, test.matches, res.Succeeded())
+			}
+		}
+
+		res, err := g.MatchTokens("Exp", scanGo(t, "f(x"))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Incomplete() {
+			t.Errorf("%s: expected an incomplete match", names[i])
+		}
+	}
+}
+
+func TestSourceInterval(t *testing.T) {
+	src := "a +  f(b)  c"
+	tokens := scanGo(t, src)
+
+	names, grammars := variants(goExprGrammar())
+	for i, g := range grammars {
+		res, err := g.MatchTokensWithOptions("Exp", tokens, MatchOptions{Prefix: true})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", names[i], err)
+		}
+		if !res.Succeeded() || res.End() != 6 {
+			t.Fatalf("%s: expected a match of 6 tokens, got %v %d", names[i], res.Succeeded(), res.End())
+		}
+
+		tests := []struct {
+			start, end       int
+			srcStart, srcEnd int
+		}{
+			{0, 6, 0, 9},
+			{2, 3, 5, 6},
+			{3, 3, 6, 6},
+			{6, 7, 11, 12},
+			{7, 7, 12, 12},
+		}
+		for _, test := range tests {
+			start, end := res.SourceInterval(test.start, test.end)
+			if start != test.srcStart || end != test.srcEnd {
+				t.Errorf("%s: interval [%d, %d) expected=[%d, %d) actual=[%d, %d)", names[i], test.start, test.end, test.srcStart, test.srcEnd, start, end)
+			}
+		}
+	}
+
+	res, err := OhmGrammar.MatchPrefix("ident", "abc def")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if start, end := res.SourceInterval(0, res.End()); start != 0 || end != 3 {
+		t.Errorf("expected text intervals to be unchanged, got [%d, %d)", start, end)
+	}
+}
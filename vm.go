@@ -0,0 +1,932 @@
+package ohm
+
+import (
+	"errors"
+	"fmt"
+)
+
+type opcode uint8
+
+const (
+	opAny opcode = iota
+	opChar
+	opClass
+	opByte
+	opToken
+	opIndent
+	opDedent
+	opNative
+	opMark
+	opCheck
+	opCapture
+	opBackReference
+	opRecovered
+	opChoice
+	opPredicate
+	opCommit
+	opPartialCommit
+	opBackCommit
+	opPredicateCommit
+	opJump
+	opTest
+	opFailTwice
+	opFail
+	opCall
+	opReturn
+	opEnd
+	opCut
+	opEval
+	opError
+)
+
+type inst struct {
+	op      opcode
+	r       rune
+	lo, hi  byte
+	tok     *TokenMatch
+	native  *Native
+	pred    *SemanticPredicate
+	name    string
+	label   int
+	class   *CharClass
+	table   *dispatchTable
+	expr    PExpr
+	lexical bool
+	alt     uint8
+	err     error
+}
+
+// Program is a grammar compiled into instructions for a parsing machine in
+// the style of LPeg. Each rule instantiation is compiled once, so matching
+// doesn't substitute parameters, recurse on the Go stack or dispatch on
+// PExpr types.
+type Program struct {
+	g     *Grammar
+	code  []inst
+	rules []int
+	names []string
+
+	// memoDecisions holds whether each instantiation is memoized according
+	// to the grammar's policies, or is nil if they all are.
+	memoDecisions []memoDecision
+
+	// starts and prefixes hold where to start matching each rule, followed
+	// by the end of the input or not.
+	starts   map[string]int
+	prefixes map[string]int
+}
+
+// Compile compiles g into a Program that gives the same results as matching
+// with g directly.
+func (g *Grammar) Compile() (*Program, error) {
+	c := &compiler{in: newInstantiator(g)}
+	p := &Program{g: g, starts: make(map[string]int), prefixes: make(map[string]int)}
+
+	seen := make(map[string]bool)
+	for sg := g; sg != nil; sg = sg.super {
+		for name := range sg.rules {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			islex, err := (&Apply{name: name}).isLexical()
+			if err != nil {
+				continue
+			}
+
+			for _, prefix := range []bool{false, true} {
+				if prefix {
+					p.prefixes[name] = len(c.code)
+				} else {
+					p.starts[name] = len(c.code)
+				}
+				if err := c.gen(startBody(name, prefix), islex); err != nil {
+					return nil, err
+				}
+				c.emit(inst{op: opEnd})
+			}
+		}
+	}
+
+	for i := 0; i < len(c.in.insts); i++ {
+		inst := c.in.insts[i]
+		c.rules = append(c.rules, len(c.code))
+		p.names = append(p.names, inst.name)
+
+		if inst.err != nil {
+			c.emit(opErrorInst(inst.err))
+			continue
+		}
+		if err := c.gen(inst.body, inst.lexical); err != nil {
+			return nil, err
+		}
+		c.emit(opReturnInst)
+	}
+
+	p.code = c.code
+	p.rules = c.rules
+	p.memoDecisions = decideAll(g.memoRules, p.names)
+	return p, nil
+}
+
+var opReturnInst = inst{op: opReturn}
+
+func opErrorInst(err error) inst {
+	return inst{op: opError, err: err}
+}
+
+type compiler struct {
+	in    *instantiator
+	code  []inst
+	rules []int
+}
+
+func (c *compiler) emit(in inst) int {
+	c.code = append(c.code, in)
+	return len(c.code) - 1
+}
+
+func (c *compiler) here() int {
+	return len(c.code)
+}
+
+func (c *compiler) patch(pc int) {
+	c.code[pc].label = c.here()
+}
+
+// gen emits code for expr evaluated in a lexical or syntactic context. Like
+// MatchState.eval, it skips spaces first in a syntactic context.
+func (c *compiler) gen(expr PExpr, lexical bool) error {
+	if !lexical {
+		if err := c.genSkip(); err != nil {
+			return err
+		}
+	}
+	return c.genBody(expr, lexical)
+}
+
+// genSkip emits an application of spaces whose failure is ignored.
+func (c *compiler) genSkip() error {
+	i, err := c.in.instantiate(&spaces)
+	if err != nil {
+		return err
+	}
+
+	choice := c.emit(inst{op: opChoice})
+	c.emit(inst{op: opCall, label: i})
+	commit := c.emit(inst{op: opCommit})
+	c.patch(choice)
+	c.patch(commit)
+	return nil
+}
+
+func (c *compiler) genBody(expr PExpr, lexical bool) error {
+	switch e := expr.(type) {
+	case *Any:
+		c.emit(inst{op: opAny})
+	case *Char:
+		c.emit(inst{op: opChar, r: e.r})
+	case *Chars, *Range, *UnicodeCategories, *CharClass:
+		c.emit(inst{op: opClass, class: primitiveClass(e)})
+	case *ByteRange:
+		c.emit(inst{op: opByte, lo: e.start, hi: e.end})
+	case *TokenMatch:
+		c.emit(inst{op: opToken, tok: e})
+	case *Indentation:
+		if e.dedent {
+			c.emit(inst{op: opDedent})
+		} else {
+			c.emit(inst{op: opIndent})
+		}
+	case *Native:
+		c.emit(inst{op: opNative, native: e})
+	case *SemanticPredicate:
+		c.emit(inst{op: opMark})
+		if err := c.gen(e.expr, lexical); err != nil {
+			return err
+		}
+		c.emit(inst{op: opCheck, pred: e})
+	case *Capture:
+		c.emit(inst{op: opMark})
+		if err := c.gen(e.expr, lexical); err != nil {
+			return err
+		}
+		c.emit(inst{op: opCapture, name: e.name})
+	case *BackReference:
+		c.emit(inst{op: opBackReference, name: e.name})
+	case *Recover:
+		return c.genRecover(e, lexical)
+	case *Alt:
+		return c.genAlt(e.exprs, lexical)
+	case *DispatchAlt:
+		return c.genDispatchAlt(e, lexical)
+	case *Seq:
+		for _, expr := range e.exprs {
+			if err := c.gen(expr, lexical); err != nil {
+				return err
+			}
+		}
+	case *Maybe:
+		choice := c.emit(inst{op: opChoice})
+		if err := c.gen(e.expr, lexical); err != nil {
+			return err
+		}
+		commit := c.emit(inst{op: opCommit})
+		c.patch(choice)
+		c.patch(commit)
+	case *Star:
+		return c.genStar(e.expr, lexical)
+	case *Plus:
+		if err := c.gen(e.expr, lexical); err != nil {
+			return err
+		}
+		return c.genStar(e.expr, lexical)
+	case *Repeat:
+		return c.genRepeat(e, lexical)
+	case *Lookahead:
+		choice := c.emit(inst{op: opPredicate})
+		if err := c.gen(e.expr, lexical); err != nil {
+			return err
+		}
+		commit := c.emit(inst{op: opBackCommit})
+		c.patch(choice)
+		c.emit(inst{op: opFail})
+		c.patch(commit)
+	case *Not:
+		choice := c.emit(inst{op: opPredicate})
+		if err := c.gen(e.expr, lexical); err != nil {
+			return err
+		}
+		c.emit(inst{op: opFailTwice})
+		c.patch(choice)
+	case *Apply:
+		i, err := c.in.instantiate(e)
+		if err != nil {
+			return err
+		}
+		c.emit(inst{op: opCall, label: i})
+	case *Cut:
+		c.emit(inst{op: opCut})
+	case *Param:
+		// Bodies are compiled with their arguments substituted, so a
+		// remaining parameter has no argument to refer to.
+		c.emit(opErrorInst(fmt.Errorf("param index out of range: %d", e.idx)))
+	default:
+		c.emit(inst{op: opEval, expr: e, lexical: lexical})
+	}
+	return nil
+}
+
+func (c *compiler) genAlt(exprs []PExpr, lexical bool) error {
+	if len(exprs) == 0 {
+		c.emit(inst{op: opFail})
+		return nil
+	}
+
+	var commits []int
+	for _, expr := range exprs[:len(exprs)-1] {
+		choice := c.emit(inst{op: opChoice})
+		if err := c.gen(expr, lexical); err != nil {
+			return err
+		}
+		commits = append(commits, c.emit(inst{op: opCommit}))
+		c.patch(choice)
+	}
+	if err := c.gen(exprs[len(exprs)-1], lexical); err != nil {
+		return err
+	}
+
+	for _, commit := range commits {
+		c.patch(commit)
+	}
+	return nil
+}
+
+// genDispatchAlt emits a DispatchAlt like an Alt, but with each alternative
+// behind a test of the next rune against the table, which skips it if it
+// can't match. In a context other than the one the table was built for,
+// nothing is tested.
+func (c *compiler) genDispatchAlt(a *DispatchAlt, lexical bool) error {
+	if lexical != a.table.lexical {
+		return c.genAlt(a.exprs, lexical)
+	}
+
+	// In a syntactic context, gen has already skipped spaces, so the tests
+	// see the rune the alternatives will.
+	var ends []int
+	last := len(a.exprs) - 1
+	for i, expr := range a.exprs {
+		test := c.emit(inst{op: opTest, table: a.table, alt: uint8(i)})
+		if i < last {
+			choice := c.emit(inst{op: opChoice})
+			if err := c.gen(expr, lexical); err != nil {
+				return err
+			}
+			ends = append(ends, c.emit(inst{op: opCommit}))
+			c.patch(choice)
+		} else {
+			if err := c.gen(expr, lexical); err != nil {
+				return err
+			}
+			ends = append(ends, c.emit(inst{op: opJump}))
+		}
+		c.patch(test)
+	}
+	c.emit(inst{op: opFail})
+
+	for _, end := range ends {
+		c.patch(end)
+	}
+	return nil
+}
+
+func (c *compiler) genStar(expr PExpr, lexical bool) error {
+	choice := c.emit(inst{op: opChoice})
+	body := c.here()
+	if err := c.gen(expr, lexical); err != nil {
+		return err
+	}
+	c.emit(inst{op: opPartialCommit, label: body})
+	c.patch(choice)
+	return nil
+}
+
+// genRecover emits e.expr in a predicate frame, which undoes its cuts, and
+// if it fails, a loop that skips a character at a time until e.sync
+// matches. See Recover.Eval.
+func (c *compiler) genRecover(e *Recover, lexical bool) error {
+	predicate := c.emit(inst{op: opPredicate})
+	if err := c.gen(e.expr, lexical); err != nil {
+		return err
+	}
+	commit := c.emit(inst{op: opPredicateCommit})
+	c.patch(predicate)
+
+	c.emit(inst{op: opMark})
+	loop := c.emit(inst{op: opChoice})
+	if err := c.gen(e.sync, lexical); err != nil {
+		return err
+	}
+	done := c.emit(inst{op: opCommit})
+	c.patch(loop)
+	if e.bytes {
+		c.emit(inst{op: opByte, lo: 0, hi: 0xff})
+	} else {
+		c.emit(inst{op: opAny})
+	}
+	c.emit(inst{op: opJump, label: loop})
+	c.patch(done)
+	c.emit(inst{op: opRecovered, name: e.name})
+	c.patch(commit)
+	return nil
+}
+
+// genRepeat emits r.expr min times, followed by a repetition if there's no
+// maximum, or else by max-min optional copies, where the first that fails
+// ends the repetition.
+func (c *compiler) genRepeat(r *Repeat, lexical bool) error {
+	if err := r.checkBounds(); err != nil {
+		c.emit(opErrorInst(err))
+		return nil
+	}
+
+	for i := 0; i < r.min; i++ {
+		if err := c.gen(r.expr, lexical); err != nil {
+			return err
+		}
+	}
+	if r.max < 0 {
+		return c.genStar(r.expr, lexical)
+	}
+
+	var choices []int
+	for i := r.min; i < r.max; i++ {
+		choices = append(choices, c.emit(inst{op: opChoice}))
+		if err := c.gen(r.expr, lexical); err != nil {
+			return err
+		}
+		c.patch(c.emit(inst{op: opCommit}))
+	}
+	for _, choice := range choices {
+		c.patch(choice)
+	}
+	return nil
+}
+
+type frameKind uint8
+
+const (
+	frameChoice frameKind = iota
+	framePredicate
+	frameCall
+	frameMark
+)
+
+// frame is an entry on the machine's backtrack stack. Choice frames hold the
+// position, indentation stack and numbers of captures and diagnostics to
+// restore and where to resume on failure. Predicate frames are choice frames
+// for lookaheads, which also restore the last cut. Call frames hold the
+// return address and the rule and position needed to memoize the result,
+// along with the caller's examined position and capture base and the number
+// of diagnostics when the rule was applied. See inputBuffer.enter. Mark
+// frames hold where a semantic predicate's or capture's expression started,
+// or where recovering from an error started.
+type frame struct {
+	kind        frameKind
+	indent      int32
+	pc          int
+	pos         int
+	rule        int
+	cut         int
+	examined    int
+	captures    int
+	diagnostics int
+}
+
+// MatchesRule reports whether input matches the rule called name, followed
+// by the end of the input.
+func (p *Program) MatchesRule(name, input string) (bool, error) {
+	res, err := p.Match(name, input)
+	if err != nil {
+		return false, err
+	}
+	return res.Succeeded(), nil
+}
+
+// Match matches input against the rule called name, followed by the end of
+// the input.
+func (p *Program) Match(name, input string) (*MatchResult, error) {
+	return p.MatchWithOptions(name, input, MatchOptions{})
+}
+
+// MatchWithOptions is like Match, configured by opts.
+func (p *Program) MatchWithOptions(name, input string, opts MatchOptions) (*MatchResult, error) {
+	return withLongestPrefix(newStringInput(input), opts, func(in *inputBuffer, opts MatchOptions) (*MatchResult, error) {
+		return p.match(name, in, opts)
+	})
+}
+
+func (p *Program) match(name string, in *inputBuffer, opts MatchOptions) (*MatchResult, error) {
+	a := Apply{name: name}
+	if _, err := a.isLexical(); err != nil {
+		return nil, err
+	}
+
+	starts := p.starts
+	if opts.Prefix {
+		starts = p.prefixes
+	}
+	start, ok := starts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rule \"%s\"", name)
+	}
+
+	vm := machinePool.Get().(*machine)
+	defer vm.free()
+	vm.p, vm.in = p, in
+	in.invalid = opts.InvalidUTF8
+	vm.memo = opts.memoTable(&vm.spare)
+	vm.memoRules = newMemoResolver(p.g, opts.Memo)
+	vm.limits = opts.limits()
+	vm.memoDecisions = p.memoDecisions
+	if opts.Memo != nil {
+		vm.memoDecisions = decideAll(vm.memoRules, p.names)
+	}
+	if opts.ProfileMemo {
+		vm.profile = make(MemoProfile)
+	}
+
+	end, res, err := vm.run(start, opts.start)
+	if err != nil {
+		return nil, err
+	}
+	return &MatchResult{
+		succeeded:   res,
+		input:       in.all(),
+		end:         end,
+		incomplete:  !res && in.pastEnd(),
+		stats:       vm.memo.stats(),
+		profile:     vm.profile,
+		tokens:      in.tokens,
+		diagnostics: diagnostics(res, vm.diagnostics),
+	}, nil
+}
+
+type machine struct {
+	p     *Program
+	in    *inputBuffer
+	stack []frame
+	memo  *memoTable
+
+	// memoRules decides which rules are memoized. The decision for each
+	// instantiation is in memoDecisions, which is nil if they all are.
+	memoRules     *memoResolver
+	memoDecisions []memoDecision
+	profile       MemoProfile
+	limits        *limits
+
+	// indent, captures, captureBase, diagnostics, cut, choices and preds are
+	// like their counterparts in MatchState.
+	// choices counts choice, predicate and mark frames, and preds counts
+	// predicate and mark frames, so nothing is released inside a semantic
+	// predicate. See SemanticPredicate.Eval.
+	indent      int32
+	captures    []capture
+	captureBase int
+	diagnostics []Diagnostic
+	cut         int
+	choices     int
+	preds       int
+
+	// state is used to evaluate expressions the compiler doesn't know about
+	// with the tree interpreter.
+	state *MatchState
+
+	// spare is the memo table the machine had when it was pooled.
+	spare *memoTable
+}
+
+var errInvalidProgram = errors.New("invalid program: unbalanced stack")
+
+// run runs the machine from pc at pos. It returns where matching ended and
+// whether it succeeded.
+func (vm *machine) run(pc, pos int) (int, bool, error) {
+	start := pos
+	code := vm.p.code
+
+	for {
+		in := &code[pc]
+		ok := true
+
+		switch in.op {
+		case opAny, opChar, opClass:
+			r, size, err := vm.in.peek(pos)
+			if err != nil {
+				return start, false, err
+			}
+			if size == 0 {
+				ok = false
+				break
+			}
+
+			switch in.op {
+			case opChar:
+				ok = r == in.r
+			case opClass:
+				ok = in.class.contains(r)
+			}
+			if ok {
+				pos += size
+				pc++
+			}
+		case opByte:
+			b, more, err := vm.in.peekByte(pos)
+			if err != nil {
+				return start, false, err
+			}
+			ok = more && b >= in.lo && b <= in.hi
+			if ok {
+				pos++
+				pc++
+			}
+		case opToken:
+			tok, more := vm.in.token(pos)
+			ok = more && in.tok.matches(tok)
+			if ok {
+				pos++
+				pc++
+			}
+		case opIndent, opDedent:
+			indent, more, err := vm.memo.indents.next(vm.in, pos, vm.indent, in.op == opDedent)
+			if err != nil {
+				return start, false, err
+			}
+			ok = more
+			if ok {
+				vm.indent = indent
+				pc++
+			}
+		case opNative:
+			end, more, err := in.native.match(vm.in, pos)
+			if err != nil {
+				return start, false, err
+			}
+			ok = more
+			if ok {
+				pos = end
+				pc++
+			}
+		case opMark:
+			vm.stack = append(vm.stack, frame{kind: frameMark, pos: pos})
+			vm.choices++
+			vm.preds++
+			pc++
+		case opCheck:
+			f := vm.stack[len(vm.stack)-1]
+			if f.kind != frameMark {
+				return start, false, errInvalidProgram
+			}
+			vm.stack = vm.stack[:len(vm.stack)-1]
+			vm.choices--
+			vm.preds--
+
+			var err error
+			ok, err = in.pred.check(vm.in, f.pos, pos)
+			if err != nil {
+				return start, false, err
+			}
+			if ok {
+				pc++
+			}
+		case opCapture:
+			f := vm.stack[len(vm.stack)-1]
+			if f.kind != frameMark {
+				return start, false, errInvalidProgram
+			}
+			vm.stack = vm.stack[:len(vm.stack)-1]
+			vm.choices--
+			vm.preds--
+
+			captured, err := newCapture(vm.in, in.name, f.pos, pos)
+			if err != nil {
+				return start, false, err
+			}
+			vm.captures = append(vm.captures, captured)
+			pc++
+		case opBackReference:
+			end, more, err := backReference(vm.in, vm.captures[vm.captureBase:], in.name, pos)
+			if err != nil {
+				return start, false, err
+			}
+			ok = more
+			if ok {
+				pos = end
+				pc++
+			}
+		case opRecovered:
+			f := vm.stack[len(vm.stack)-1]
+			if f.kind != frameMark {
+				return start, false, errInvalidProgram
+			}
+			vm.stack = vm.stack[:len(vm.stack)-1]
+			vm.choices--
+			vm.preds--
+
+			ok = pos > f.pos
+			if ok {
+				vm.diagnostics = append(vm.diagnostics, Diagnostic{Rule: in.name, Start: f.pos, End: pos})
+				pc++
+			}
+		case opChoice:
+			vm.stack = append(vm.stack, frame{kind: frameChoice, indent: vm.indent, pc: in.label, pos: pos, captures: len(vm.captures), diagnostics: len(vm.diagnostics)})
+			vm.choices++
+			pc++
+		case opPredicate:
+			vm.stack = append(vm.stack, frame{kind: framePredicate, indent: vm.indent, pc: in.label, pos: pos, cut: vm.cut, captures: len(vm.captures), diagnostics: len(vm.diagnostics)})
+			vm.choices++
+			vm.preds++
+			pc++
+		case opCommit:
+			vm.stack = vm.stack[:len(vm.stack)-1]
+			vm.choices--
+			pc = in.label
+		case opPartialCommit:
+			// The end of an iteration of a repetition. See
+			// MatchState.settle.
+			f := &vm.stack[len(vm.stack)-1]
+			f.pos, f.indent, f.captures, f.diagnostics = pos, vm.indent, len(vm.captures), len(vm.diagnostics)
+			if vm.choices == 1 {
+				vm.release(pos)
+			}
+			if vm.limits != nil {
+				if err := vm.limits.step(pos); err != nil {
+					return start, false, err
+				}
+			}
+			pc = in.label
+		case opBackCommit:
+			f := vm.popPredicate()
+			pos, vm.indent, vm.captures = f.pos, f.indent, vm.captures[:f.captures]
+			vm.diagnostics = vm.diagnostics[:f.diagnostics]
+			pc = in.label
+		case opPredicateCommit:
+			// The end of a rule that didn't need to recover. See
+			// Recover.Eval.
+			vm.popPredicate()
+			pc = in.label
+		case opJump:
+			pc = in.label
+		case opTest:
+			if in.table.candidates(vm.in, pos)&(1<<in.alt) != 0 {
+				pc++
+			} else {
+				pc = in.label
+			}
+		case opFailTwice:
+			vm.popPredicate()
+			ok = false
+		case opFail:
+			ok = false
+		case opCall:
+			if vm.limits != nil {
+				if err := vm.limits.step(pos); err != nil {
+					return start, false, err
+				}
+			}
+			if vm.memoizes(in.label) {
+				e, hit := vm.memo.get(int32(in.label), pos, vm.indent)
+				if vm.profile != nil {
+					vm.profile.record(vm.p.names[in.label], hit)
+				}
+				if hit {
+					vm.in.hit(e)
+					if e.res {
+						vm.diagnostics = vm.memo.replayDiagnostics(vm.diagnostics, pos, e.id)
+					}
+					if e.cut && e.res {
+						vm.cutAt(e.end)
+					} else if e.cut {
+						vm.cutAt(pos + 1)
+					}
+
+					ok = e.res
+					if ok {
+						pos = e.end
+						vm.indent = vm.memo.indents.to(e.indent)
+						pc++
+					}
+					break
+				}
+			}
+			if vm.limits != nil {
+				if err := vm.limits.enter(pos); err != nil {
+					return start, false, err
+				}
+			}
+			examined := vm.in.enter(pos)
+			vm.stack = append(vm.stack, frame{kind: frameCall, indent: vm.indent, pc: pc + 1, pos: pos, rule: in.label, examined: examined, captures: vm.captureBase, diagnostics: len(vm.diagnostics)})
+			vm.captureBase = len(vm.captures)
+			pc = vm.p.rules[in.label]
+		case opReturn:
+			f := vm.stack[len(vm.stack)-1]
+			if f.kind != frameCall {
+				return start, false, errInvalidProgram
+			}
+			vm.stack = vm.stack[:len(vm.stack)-1]
+			if err := vm.exit(f, true, pos); err != nil {
+				return start, false, err
+			}
+			pc = f.pc
+		case opCut:
+			vm.cutAt(pos)
+			pc++
+		case opEnd:
+			return pos, true, nil
+		case opEval:
+			end, res, err := vm.eval(in.expr, in.lexical, pos)
+			if err != nil {
+				return start, false, err
+			}
+			ok = res
+			if ok {
+				pos = end
+				pc++
+			}
+		case opError:
+			return start, false, in.err
+		}
+
+		if ok {
+			continue
+		}
+
+		// Backtrack to the most recent choice that didn't start before a
+		// cut, memoizing the failure of every rule application we unwind on
+		// the way.
+		for {
+			if len(vm.stack) == 0 {
+				return start, false, nil
+			}
+
+			f := vm.stack[len(vm.stack)-1]
+			vm.stack = vm.stack[:len(vm.stack)-1]
+
+			switch f.kind {
+			case frameCall:
+				if err := vm.exit(f, false, f.pos); err != nil {
+					return start, false, err
+				}
+				continue
+			case frameMark:
+				vm.choices--
+				vm.preds--
+				continue
+			case frameChoice:
+				vm.choices--
+				if vm.cut > f.pos {
+					continue
+				}
+			case framePredicate:
+				vm.choices--
+				vm.preds--
+				vm.cut = f.cut
+			}
+
+			pos, vm.indent, vm.captures = f.pos, f.indent, vm.captures[:f.captures]
+			vm.diagnostics = vm.diagnostics[:f.diagnostics]
+			pc = f.pc
+			break
+		}
+	}
+}
+
+// exit memoizes the result of the application in call frame f, and drops
+// its captures, and its diagnostics if it failed.
+func (vm *machine) exit(f frame, res bool, end int) error {
+	vm.captures = vm.captures[:vm.captureBase]
+	vm.captureBase = f.captures
+
+	indent := f.indent
+	if res {
+		indent = vm.indent
+	} else {
+		vm.diagnostics = vm.diagnostics[:f.diagnostics]
+	}
+
+	e := memoEntry{id: int32(f.rule), res: res, cut: vm.cut > f.pos, end: end}
+	vm.in.exit(f.examined, &e)
+	memoize := vm.memoizes(f.rule) && vm.memo.indented(&e, f.indent, indent)
+	if memoize {
+		vm.memo.set(f.pos, e)
+		vm.memo.diagnose(f.pos, e.id, vm.diagnostics[f.diagnostics:])
+	}
+	if vm.limits == nil {
+		return nil
+	}
+
+	vm.limits.exit()
+	if memoize {
+		return vm.limits.memoized(vm.memo, f.pos)
+	}
+	return nil
+}
+
+// popPredicate pops a predicate frame, restoring the last cut.
+func (vm *machine) popPredicate() frame {
+	f := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	vm.choices--
+	vm.preds--
+	vm.cut = f.cut
+	return f
+}
+
+// cutAt is like MatchState.cutAt.
+func (vm *machine) cutAt(pos int) {
+	if pos > vm.cut {
+		vm.cut = pos
+	}
+	if vm.preds == 0 {
+		vm.release(pos)
+	}
+}
+
+func (vm *machine) release(pos int) {
+	vm.memo.release(pos)
+	vm.in.release(pos)
+}
+
+func (vm *machine) memoizes(rule int) bool {
+	return vm.memoDecisions == nil || vm.memoDecisions[rule] == memoYes
+}
+
+// eval evaluates expr at pos with the tree interpreter.
+func (vm *machine) eval(expr PExpr, lexical bool, pos int) (int, bool, error) {
+	if vm.state == nil {
+		vm.state = &MatchState{
+			g:         vm.p.g,
+			in:        vm.in,
+			memo:      &memoTable{},
+			memoRules: vm.memoRules,
+			profile:   vm.profile,
+			limits:    vm.limits,
+		}
+	}
+
+	m := vm.state
+	m.pos = pos
+	m.indent = vm.memo.indents.move(vm.indent, &m.memo.indents)
+	m.captures = append(m.captures[:0], vm.captures[vm.captureBase:]...)
+	m.diagnostics = m.diagnostics[:0]
+	m.stack = []call{{app: &Apply{}, lexical: lexical}}
+
+	res, err := expr.Eval(m)
+	if err != nil || !res {
+		return pos, false, err
+	}
+	vm.indent = m.memo.indents.move(m.indent, &vm.memo.indents)
+	vm.captures = append(vm.captures[:vm.captureBase], m.captures...)
+	vm.diagnostics = append(vm.diagnostics, m.diagnostics...)
+	return m.pos, true, nil
+}
@@ -0,0 +1,135 @@
+package ohm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompiledOhmGrammar(t *testing.T) {
+	for _, g := range []*Grammar{&OhmGrammar, OhmGrammar.Optimize()} {
+		prog, err := g.Compile()
+		if err != nil {
+			t.Fatalf("unexpected compile error: %s", err)
+		}
+
+		res, err := prog.MatchesRule("Grammars", ohmGrammarSource)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !res {
+			t.Errorf("expected=true actual=false")
+		}
+
+		broken := strings.Replace(ohmGrammarSource, "= Grammar*", "= Grammar* =", 1)
+		res, err = prog.MatchesRule("Grammars", broken)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if res {
+			t.Errorf("broken grammar: expected=false actual=true")
+		}
+	}
+}
+
+func TestCompiledErrors(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"start":   seq(lit("a"), apply("missing")),
+		"invalid": lit("a"),
+	})
+
+	tests := []struct {
+		rule  string
+		input string
+		err   string
+	}{
+		{"start", "b", ""},
+		{"start", "a", `unknown rule "missing"`},
+		{"invalid", "\xff", "invalid rune at pos 0"},
+		{"nope", "", `unknown rule "nope"`},
+	}
+
+	names, grammars := variants(g)
+	for i, g := range grammars {
+		for _, test := range tests {
+			_, err := g.MatchesRule(test.rule, test.input)
+			if (err == nil) != (test.err == "") || (err != nil && err.Error() != test.err) {
+				t.Errorf("%s: rule=%s input=%q expected error %q, got %v", names[i], test.rule, test.input, test.err, err)
+			}
+		}
+	}
+}
+
+// twice matches its expression twice. The compiler doesn't know about it, so
+// it exercises evaluating unknown expressions with the interpreter.
+type twice struct {
+	expr PExpr
+}
+
+func (t *twice) Eval(m *MatchState) (bool, error) {
+	return (&Seq{[]PExpr{t.expr, t.expr}}).Eval(m)
+}
+
+func (t *twice) substituteParams(args []PExpr) (PExpr, error) {
+	expr, err := t.expr.substituteParams(args)
+	if err != nil {
+		return nil, err
+	}
+	return &twice{expr}, nil
+}
+
+func TestCompiledUnknownExpr(t *testing.T) {
+	g := grammar(map[string]PExpr{
+		"Start": seq(&twice{apply("ab")}, lit("c")),
+		"ab":    alt(lit("a"), lit("b")),
+	})
+
+	testMatchesRule(t, g, "Start", []test{
+		{"abc", true},
+		{"a b c", true},
+		{"aa c", true},
+		{"ac", false},
+		{"abac", false},
+	})
+}
+
+func TestInstantiationKeys(t *testing.T) {
+	in := newInstantiator(&OhmGrammar)
+
+	a, _ := in.instantiate(&Apply{name: "NonemptyListOf", args: []PExpr{apply("Seq"), &Char{'|'}}})
+	b, _ := in.instantiate(&Apply{name: "NonemptyListOf", args: []PExpr{apply("TopLevelTerm"), &Char{'|'}}})
+	c, _ := in.instantiate(&Apply{name: "NonemptyListOf", args: []PExpr{apply("Seq"), &Char{'|'}}})
+
+	if a == b {
+		t.Errorf("expected different arguments to get different instantiations")
+	}
+	if a != c {
+		t.Errorf("expected equal arguments to share an instantiation")
+	}
+}
+
+func BenchmarkOhmGrammarVM(b *testing.B) {
+	benchmarkOhmGrammarVM(b, &OhmGrammar)
+}
+
+func BenchmarkOhmGrammarVMOptimized(b *testing.B) {
+	benchmarkOhmGrammarVM(b, OhmGrammar.Optimize())
+}
+
+func benchmarkOhmGrammarVM(b *testing.B, g *Grammar) {
+	prog, err := g.Compile()
+	if err != nil {
+		b.Fatalf("unexpected compile error: %s", err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(ohmGrammarSource)))
+	for i := 0; i < b.N; i++ {
+		res, err := prog.MatchesRule("Grammars", ohmGrammarSource)
+		if err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+		if !res {
+			b.Fatalf("expected=true actual=false")
+		}
+	}
+}